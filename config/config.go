@@ -1,9 +1,13 @@
 package config
 
 import (
+	"bytes"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -11,9 +15,44 @@ import (
 // Parameters is the main configuration struct
 type Parameters struct {
 	Server  Server  `yaml:"server"`
-	Fan     Fan     `yaml:"fan"`
+	Fan     Fan     `yaml:"fan"`  // Single fan, following CPU temperature by default
+	Fans    []Fan   `yaml:"fans"` // More fans, each one must have a unique name
 	Modules Modules `yaml:"modules"`
 	Storage Storage `yaml:"storage"`
+	Thermal Thermal `yaml:"thermal"`
+	History History `yaml:"history"`
+	File    string  `yaml:"-"` // config file the parameters were loaded from
+}
+
+// History is the retention of in-memory data, by resolution. Older samples are dropped
+type History struct {
+	Seconds time.Duration `yaml:"seconds"` // samples taken every second, 2h by default
+	Minutes time.Duration `yaml:"minutes"` // samples aggregated by minute, 168h (7 days) by default
+	// stored data loaded into memory at start, minutes retention by default
+	WarmStart time.Duration `yaml:"warmStart"`
+}
+
+// WithDefaults returns the retention with unset values defaulted
+func (h History) WithDefaults() History {
+	if h.Seconds <= 0 {
+		h.Seconds = 2 * time.Hour
+	}
+	if h.Minutes <= 0 {
+		h.Minutes = 7 * 24 * time.Hour
+	}
+	if h.WarmStart <= 0 || h.WarmStart > h.Minutes {
+		h.WarmStart = h.Minutes
+	}
+	return h
+}
+
+// FanList returns all configured fans, the one from fan section goes first
+func (p *Parameters) FanList() []Fan {
+	var fans []Fan
+	if p.Fan.ControlPin != "" || p.Fan.TachPin != "" || p.Fan.CoolingDevice != "" {
+		fans = append(fans, p.Fan)
+	}
+	return append(fans, p.Fans...)
 }
 
 type Modules struct {
@@ -21,6 +60,10 @@ type Modules struct {
 	HTU21  HTU21  `yaml:"htu21"`
 	System System `yaml:"system"`
 	Smc768 Smc768 `yaml:"smc768"`
+	// Temperatures of all kernel thermal zones, each zone is its own topic
+	Zones ThermalZones `yaml:"zones"`
+	// Raspberry Pi firmware undervoltage and throttling flags
+	Throttled Throttled `yaml:"throttled"`
 	// to scan for i2c interfaces:
 	// $ i2cdetect -l
 	// i2c-4	i2c	400000002.i2c	I²C adapter
@@ -28,13 +71,279 @@ type Modules struct {
 }
 
 type Fan struct {
+	// Fan name, used in /status, /fullData and storage topics.
+	// Fan from fan section may have no name, it's reported as before, "fan" in /status
+	Name string `yaml:"name"`
+	// Temperature the fan follows: thermal zone (thermal_zone0 by default)
+	// or topic of the loaded module, like bmp280/temp or smc768/TC0C
+	Input string `yaml:"input"`
+	// Multiplier to get m˚C from module topic value, 1 by default. bmp280/temp is in ˚C, so 1000
+	InputScale float64 `yaml:"inputScale"`
 	// GPIO Fan tachymeter connected to
 	// Tachymeter usually is a yellow wire in 3-pin fan connector
 	TachPin string `yaml:"tachPin"`
+	// Tachometer pulses per revolution, 2 for most PC fans (default)
+	PPR int `yaml:"ppr"`
+	// Minimal spacing between tachometer pulses, µs. Closer pulses are ignored as glitches
+	TachFilter int `yaml:"tachFilter"`
 	// GPIO Fan control connected to (base of transistor)
 	ControlPin string `yaml:"controlPin"`
-	High       int    `yaml:"high"` // Fan activation temperature ˚C
-	Low        int    `yaml:"low"`  // Fan deactivation temperature ˚C
+	// Fan activation and deactivation temperatures ˚C.
+	// Suggested from the input thermal zone trip points if both are unset
+	High int `yaml:"high"`
+	Low  int `yaml:"low"`
+	// Fan control mode:
+	// onoff - (default) ControlPin is switched high or low
+	// pwm - ControlPin drives the fan with PWM signal
+	// cooling - fan is driven through the kernel CoolingDevice, for gpio-fan and pwm-fan overlays
+	Mode string `yaml:"mode"`
+	PWM  PWM    `yaml:"pwm"`
+	// Kernel cooling device, like cooling_device0, used in cooling mode
+	CoolingDevice string `yaml:"coolingDevice"`
+	// Fan control policy:
+	// hysteresis - (default) fan is turned on above High and off below Low
+	// pid - fan duty is adjusted to hold the temperature at PID.Setpoint
+	// curve - fan duty follows temperature → duty curve
+	Policy     string     `yaml:"policy"`
+	Hysteresis Hysteresis `yaml:"hysteresis"`
+	PID        PID        `yaml:"pid"`
+	Curve      Curve      `yaml:"curve"`
+	Stall      Stall      `yaml:"stall"`
+	// Raises fan duty with CPU load, before the temperature climbs. Off if Gain is 0
+	FeedForward FeedForward `yaml:"feedForward"`
+	// Time windows with their own thresholds and policy parameters, like quiet hours.
+	// The first matching profile is active, the fan section itself applies otherwise
+	Profiles []Profile `yaml:"profiles"`
+	// Candidate policies evaluated alongside the active one, see /fan/shadow
+	Shadow []Shadow `yaml:"shadow"`
+	// Fan runs at full speed above this temperature ˚C whatever the profile or manual mode, 80 by default
+	Critical int `yaml:"critical"`
+	// Running hours after which the maintenance alert is raised, like the expected fan life. Off if 0
+	MaintenanceHours int `yaml:"maintenanceHours"`
+	// Fan check with tachymeter, at start or through POST /fan/selftest
+	SelfTest SelfTest `yaml:"selfTest"`
+}
+
+// SelfTest drives the fan on and off checking its rpm follows, and sweeps PWM duty.
+// Fan failing the test is kept at full speed
+type SelfTest struct {
+	OnStart  bool `yaml:"onStart"`  // Run the self-test at start
+	Timeout  int  `yaml:"timeout"`  // Seconds for tachymeter pulses to appear at full speed, 5 by default
+	SpinDown int  `yaml:"spinDown"` // Seconds for rpm to decay with the fan off, 10 by default
+	Settle   int  `yaml:"settle"`   // Seconds at full speed and at each PWM sweep step, 5 by default
+}
+
+// Profile overrides fan parameters in its time window, unset ones are inherited from the fan
+type Profile struct {
+	Name   string   `yaml:"name"`
+	Days   []string `yaml:"days"` // mon, tue, wed, thu, fri, sat, sun. Every day if empty
+	From   string   `yaml:"from"` // HH:MM, window start
+	To     string   `yaml:"to"`   // HH:MM, window end, earlier than From for overnight windows, must differ from From
+	Tuning `yaml:",inline"`
+}
+
+// Shadow policy runs on live data without driving the fan, unset parameters are inherited from the fan
+type Shadow struct {
+	Name   string `yaml:"name"`
+	Tuning `yaml:",inline"`
+}
+
+// Tuning is the set of fan parameters profiles and shadow policies can override
+type Tuning struct {
+	High       int         `yaml:"high"`
+	Low        int         `yaml:"low"`
+	MaxDuty    int         `yaml:"maxDuty"` // Duty cap %, no cap if 0
+	Policy     string      `yaml:"policy"`
+	Hysteresis *Hysteresis `yaml:"hysteresis"`
+	PID        *PID        `yaml:"pid"`
+	Curve      *Curve      `yaml:"curve"`
+	// FeedForward applies to the policy of the profile or shadow
+	FeedForward *FeedForward `yaml:"feedForward"`
+}
+
+// WithTuning returns fan parameters with the tuning applied
+func (f Fan) WithTuning(t Tuning) Fan {
+	if t.High != 0 {
+		f.High = t.High
+	}
+	if t.Low != 0 {
+		f.Low = t.Low
+	}
+	if t.Policy != "" {
+		f.Policy = t.Policy
+	}
+	if t.Hysteresis != nil {
+		f.Hysteresis = *t.Hysteresis
+	}
+	if t.PID != nil {
+		f.PID = *t.PID
+	}
+	if t.Curve != nil {
+		f.Curve = *t.Curve
+	}
+	if t.FeedForward != nil {
+		f.FeedForward = *t.FeedForward
+	}
+	f.Profiles, f.Shadow = nil, nil
+	return f
+}
+
+// Weekdays returns the days profile is active on, all days if none set
+func (p Profile) Weekdays() (map[time.Weekday]bool, error) {
+	names := map[string]time.Weekday{"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday,
+		"wed": time.Wednesday, "thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday}
+	days := map[time.Weekday]bool{}
+	for _, d := range p.Days {
+		wd, ok := names[strings.ToLower(d)]
+		if !ok {
+			return nil, fmt.Errorf("profile %s: unknown day %s", p.Name, d)
+		}
+		days[wd] = true
+	}
+	if len(days) == 0 {
+		for _, wd := range names {
+			days[wd] = true
+		}
+	}
+	return days, nil
+}
+
+// Window returns profile window bounds in minutes since midnight, equal bounds are rejected as an empty window
+func (p Profile) Window() (from, to int, err error) {
+	parse := func(hhmm string) (int, error) {
+		t, err := time.Parse("15:04", hhmm)
+		if err != nil {
+			return 0, fmt.Errorf("profile %s: bad time %q, use HH:MM", p.Name, hhmm)
+		}
+		return t.Hour()*60 + t.Minute(), nil
+	}
+	if from, err = parse(p.From); err != nil {
+		return 0, 0, err
+	}
+	if to, err = parse(p.To); err != nil {
+		return 0, 0, err
+	}
+	if from == to {
+		return 0, 0, fmt.Errorf("profile %s: window %s-%s is empty, from and to must differ", p.Name, p.From, p.To)
+	}
+	return from, to, nil
+}
+
+// Fan stall detection, works when both TachPin and ControlPin are set
+type Stall struct {
+	Timeout int `yaml:"timeout"` // Seconds rpm disagrees with the command before the fault is raised, default 30
+	MinRPM  int `yaml:"minRpm"`  // Fan spinning slower is considered stopped, default 100
+	Retries int `yaml:"retries"` // Kick-start attempts for the stalled fan, default 3
+}
+
+// Hysteresis policy parameters, offsets from High and Low temperatures in ˚C
+// Defaults are used for unset ones
+type Hysteresis struct {
+	Spike   int `yaml:"spike"`   // 10s average above High+Spike turns the fan on, default 10
+	Rise    int `yaml:"rise"`    // 30s average above High+Rise turns the fan on, default 5
+	Settle  int `yaml:"settle"`  // 1m average below Low-Settle turns the fan off, default 1
+	Decline int `yaml:"decline"` // 30s average below Low-Decline turns the fan off, default 2
+	Drop    int `yaml:"drop"`    // 10s average below Low-Drop turns the fan off, default 4
+}
+
+// WithDefaults returns the offsets with unset values defaulted
+func (h Hysteresis) WithDefaults() Hysteresis {
+	if h.Spike <= 0 {
+		h.Spike = 10
+	}
+	if h.Rise <= 0 {
+		h.Rise = 5
+	}
+	if h.Settle <= 0 {
+		h.Settle = 1
+	}
+	if h.Decline <= 0 {
+		h.Decline = 2
+	}
+	if h.Drop <= 0 {
+		h.Drop = 4
+	}
+	return h
+}
+
+// PID policy parameters, works best with Mode: pwm
+type PID struct {
+	Setpoint int     `yaml:"setpoint"` // Target temperature ˚C
+	Kp       float64 `yaml:"kp"`       // Proportional gain, duty % per ˚C
+	Ki       float64 `yaml:"ki"`       // Integral gain, duty % per ˚C per second
+	Kd       float64 `yaml:"kd"`       // Derivative gain, duty % per ˚C/s
+	DFilter  float64 `yaml:"dFilter"`  // Derivative low-pass filter, 0 - off, closer to 1 - smoother
+	Period   int     `yaml:"period"`   // Seconds between updates, default 5
+	MinDuty  int     `yaml:"minDuty"`  // Output clamping, duty %, 0 by default
+	MaxDuty  int     `yaml:"maxDuty"`  // Output clamping, duty %, 100 by default
+}
+
+// FeedForward adds duty proportional to CPU utilisation (from /proc/stat) to the policy output
+type FeedForward struct {
+	Gain      float64 `yaml:"gain"`      // Duty % per utilisation % above Threshold
+	Threshold int     `yaml:"threshold"` // Utilisation % below which there is no contribution
+	Window    int     `yaml:"window"`    // Seconds utilisation is averaged over, default 5
+}
+
+// Curve policy parameters
+type Curve struct {
+	Points []CurvePoint `yaml:"points"` // Duty is interpolated linearly between points
+	Rise   float64      `yaml:"rise"`   // ˚C the temperature has to rise by to move along the curve
+	Fall   float64      `yaml:"fall"`   // ˚C the temperature has to fall by to move along the curve
+	Input  string       `yaml:"input"`  // Temperature average to use: 10s, 30s (default) or 1m
+}
+
+type CurvePoint struct {
+	Temp float64 `yaml:"temp"` // ˚C
+	Duty int     `yaml:"duty"` // %
+}
+
+// PWM fan control parameters
+// Hardware PWM is available on GPIO12, GPIO13, GPIO18 and GPIO19,
+// software PWM is used on other pins
+type PWM struct {
+	Frequency int `yaml:"frequency"` // PWM frequency, Hz. 25000 if not set
+	MinDuty   int `yaml:"minDuty"`   // Minimal duty (%) the fan keeps spinning at
+	KickDuty  int `yaml:"kickDuty"`  // Duty (%) applied for a second to start the stopped fan
+}
+
+// Thermal actions, taken when fans alone can't keep up
+type Thermal struct {
+	// Root of sysfs, /sys by default. Can point to a fake tree for testing
+	Sysfs     string    `yaml:"sysfs"`
+	CPUFreq   CPUFreq   `yaml:"cpufreq"`
+	Emergency Emergency `yaml:"emergency"`
+}
+
+// Emergency is the last resort escalation chain, run while the temperature stays above Critical.
+// Each step runs once after its delay, the chain starts over when the temperature drops below Critical
+type Emergency struct {
+	Enabled       bool    `yaml:"enabled"`
+	Input         string  `yaml:"input"`         // Temperature to follow, like fan input. thermal_zone0 by default
+	InputScale    float64 `yaml:"inputScale"`    // Multiplier to get m˚C from module topic value, 1 by default
+	Critical      int     `yaml:"critical"`      // ˚C
+	LogAfter      int     `yaml:"logAfter"`      // Seconds above Critical before the warning is logged, 10 by default
+	Notify        string  `yaml:"notify"`        // URL to POST the alert to, optional
+	NotifyAfter   int     `yaml:"notifyAfter"`   // Seconds, 30 by default
+	Command       string  `yaml:"command"`       // Shell command to run, optional
+	CommandAfter  int     `yaml:"commandAfter"`  // Seconds, 60 by default
+	Shutdown      bool    `yaml:"shutdown"`      // Shut the system down
+	ShutdownAfter int     `yaml:"shutdownAfter"` // Seconds, 300 by default, 60 at least
+	ShutdownCmd   string  `yaml:"shutdownCmd"`   // "shutdown -h now" by default
+	DryRun        bool    `yaml:"dryRun"`        // Only log what would be done, no notifications, commands or shutdown
+}
+
+// CPUFreq caps CPU frequency while the temperature stays high, before firmware throttling does.
+// Original settings are restored on recovery and on shutdown
+type CPUFreq struct {
+	Enabled    bool    `yaml:"enabled"`
+	Input      string  `yaml:"input"`      // Temperature to follow, like fan input. thermal_zone0 by default
+	InputScale float64 `yaml:"inputScale"` // Multiplier to get m˚C from module topic value, 1 by default
+	Above      int     `yaml:"above"`      // ˚C, frequency is capped above it
+	Below      int     `yaml:"below"`      // ˚C, settings are restored below it, Above-5 by default
+	Duration   int     `yaml:"duration"`   // Seconds the temperature has to stay above or below, 60 by default
+	MaxFreq    int     `yaml:"maxFreq"`    // kHz, scaling_max_freq to set, unchanged if 0
+	Governor   string  `yaml:"governor"`   // scaling_governor to set, like powersave, unchanged if empty
 }
 
 type Server struct {
@@ -49,8 +358,28 @@ type Storage struct {
 	// Path to the database file
 	// Used only with sqlite storage
 	Path string `yaml:"path"`
-	// ReadOnly mode - no writes to the database, no tables creation
+	// ReadOnly mode - no writes to the database, no tables creation or migrations
 	ReadOnly bool `yaml:"readOnly"`
+	// Retention of stored data by tier, older data is rolled up and deleted
+	Retention Retention `yaml:"retention"`
+}
+
+// Retention is how long stored data is kept, by tier
+type Retention struct {
+	Raw    time.Duration `yaml:"raw"`    // samples by minute, 720h (30 days) by default
+	Hourly time.Duration `yaml:"hourly"` // hourly min/avg/max, 17520h (2 years) by default
+	Daily  time.Duration `yaml:"daily"`  // daily min/avg/max, forever by default
+}
+
+// WithDefaults returns the retention with unset values defaulted
+func (r Retention) WithDefaults() Retention {
+	if r.Raw <= 0 {
+		r.Raw = 30 * 24 * time.Hour
+	}
+	if r.Hourly <= 0 {
+		r.Hourly = 2 * 365 * 24 * time.Hour
+	}
+	return r
 }
 
 // to find out address of the device, use i2cdetect with -y option with the bus number
@@ -69,6 +398,14 @@ type System struct {
 type Smc768 struct {
 	Enabled bool `yaml:"enabled,omitempty"`
 }
+type ThermalZones struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+}
+type Throttled struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+	// Run vcgencmd get_throttled instead of reading the firmware sysfs node
+	Vcgencmd bool `yaml:"vcgencmd,omitempty"`
+}
 
 // New creates a new Parameters from the given file
 func NewConfig(fname string) (*Parameters, error) {
@@ -82,6 +419,201 @@ func NewConfig(fname string) (*Parameters, error) {
 		log.Printf("[ERROR] failed to parse config %s: %e", fname, err)
 		return nil, fmt.Errorf("failed to parse config %s: %w", fname, err)
 	}
+	if err = p.validate(); err != nil {
+		log.Printf("[ERROR] invalid config %s: %e", fname, err)
+		return nil, fmt.Errorf("invalid config %s: %w", fname, err)
+	}
+	p.File = fname
 	log.Printf("[DEBUG] config: %+v", p)
 	return p, nil
 }
+
+func (p *Parameters) validate() error {
+	names := map[string]bool{p.Fan.Name: p.Fan.Name != ""}
+	for _, f := range p.Fans {
+		if f.Name == "" {
+			return fmt.Errorf("fans: every fan must have a name")
+		}
+		if names[f.Name] {
+			return fmt.Errorf("fans: duplicate fan name %s", f.Name)
+		}
+		names[f.Name] = true
+	}
+	for _, f := range p.FanList() {
+		if f.Mode == "cooling" && f.CoolingDevice == "" {
+			return fmt.Errorf("fans: %s in cooling mode must have coolingDevice", f.Name)
+		}
+	}
+	if c := p.Thermal.CPUFreq; c.Enabled {
+		if c.Above <= 0 {
+			return fmt.Errorf("cpufreq: above temperature must be set")
+		}
+		if c.MaxFreq <= 0 && c.Governor == "" {
+			return fmt.Errorf("cpufreq: maxFreq or governor must be set")
+		}
+	}
+	if e := p.Thermal.Emergency; e.Enabled {
+		if e.Critical <= 0 {
+			return fmt.Errorf("emergency: critical temperature must be set")
+		}
+		if e.Shutdown && e.ShutdownAfter != 0 && e.ShutdownAfter < 60 {
+			return fmt.Errorf("emergency: shutdownAfter must be at least 60 seconds")
+		}
+	}
+	for _, f := range p.FanList() {
+		for _, pr := range f.Profiles {
+			if pr.Name == "" {
+				return fmt.Errorf("profiles: every profile must have a name")
+			}
+			if _, _, err := pr.Window(); err != nil {
+				return err
+			}
+			if _, err := pr.Weekdays(); err != nil {
+				return err
+			}
+			if pr.MaxDuty < 0 || pr.MaxDuty > 100 {
+				return fmt.Errorf("profile %s: maxDuty %d%% is out of 0-100 range", pr.Name, pr.MaxDuty)
+			}
+		}
+		shadows := map[string]bool{}
+		for _, sh := range f.Shadow {
+			if sh.Name == "" || shadows[sh.Name] {
+				return fmt.Errorf("shadow: every shadow policy must have a unique name")
+			}
+			shadows[sh.Name] = true
+		}
+		if err := ValidatePID(f); err != nil && !f.TripThresholds() {
+			return err
+		}
+	}
+	return nil
+}
+
+// TripThresholds reports if High and Low are left to be suggested from the input thermal zone trip points
+func (f Fan) TripThresholds() bool {
+	return f.High == 0 && f.Low == 0 && !strings.Contains(f.Input, "/")
+}
+
+// ValidatePID checks PID policy of the fan, its profiles and shadows has a setpoint,
+// it falls back to High temperature and the fan would be pinned at full speed with neither.
+// Fans with thresholds suggested from trip points are checked again once they are applied
+func ValidatePID(f Fan) error {
+	name := f.Name
+	if name == "" {
+		name = "fan"
+	}
+	check := func(what string, t Fan) error {
+		if t.Policy == "pid" && t.PID.Setpoint <= 0 && t.High <= 0 {
+			return fmt.Errorf("pid: %s must have setpoint or high temperature set", what)
+		}
+		return nil
+	}
+	if err := check(name, f); err != nil {
+		return err
+	}
+	for _, pr := range f.Profiles {
+		if err := check(name+" profile "+pr.Name, f.WithTuning(pr.Tuning)); err != nil {
+			return err
+		}
+	}
+	for _, sh := range f.Shadow {
+		if err := check(name+" shadow "+sh.Name, f.WithTuning(sh.Tuning)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveTuning writes fan thresholds and PID parameters to the config file, keeping the rest of it.
+// PID parameters are written only if the fan, or the tuning, uses pid policy.
+// Fan section is updated if fan name is empty, the fan from fans list otherwise.
+// Previous version of the file is kept with .bak suffix
+func SaveTuning(fname, fan string, t Tuning) error {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return fmt.Errorf("can't read config %s: %w", fname, err)
+	}
+	var doc yaml.Node
+	if err = yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("failed to parse config %s: %w", fname, err)
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return fmt.Errorf("config %s is not a mapping", fname)
+	}
+
+	var section *yaml.Node
+	if fan == "" {
+		section = mappingValue(doc.Content[0], "fan")
+	} else {
+		for _, f := range mappingValue(doc.Content[0], "fans").Content {
+			if name := lookup(f, "name"); name != nil && name.Value == fan {
+				section = f
+			}
+		}
+		if section == nil {
+			return fmt.Errorf("fan %s is not found in %s", fan, fname)
+		}
+	}
+
+	if t.High != 0 {
+		setScalar(section, "high", strconv.Itoa(t.High))
+	}
+	if t.Low != 0 {
+		setScalar(section, "low", strconv.Itoa(t.Low))
+	}
+	policy := t.Policy
+	if p := lookup(section, "policy"); policy == "" && p != nil {
+		policy = p.Value
+	}
+	if t.PID != nil && policy == "pid" {
+		pid := mappingValue(section, "pid")
+		setScalar(pid, "setpoint", strconv.Itoa(t.PID.Setpoint))
+		setScalar(pid, "kp", strconv.FormatFloat(t.PID.Kp, 'f', -1, 64))
+		setScalar(pid, "ki", strconv.FormatFloat(t.PID.Ki, 'f', -1, 64))
+		setScalar(pid, "kd", strconv.FormatFloat(t.PID.Kd, 'f', -1, 64))
+	}
+
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err = enc.Encode(&doc); err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+	if err = os.WriteFile(fname+".bak", data, 0o600); err != nil {
+		return fmt.Errorf("failed to backup config: %w", err)
+	}
+	return os.WriteFile(fname, out.Bytes(), 0o600)
+}
+
+// lookup returns the value of the key in yaml mapping, nil if there is none
+func lookup(m *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// mappingValue returns the value of the key in yaml mapping, adding an empty mapping if there is none
+func mappingValue(m *yaml.Node, key string) *yaml.Node {
+	if v := lookup(m, key); v != nil {
+		if v.Kind == yaml.ScalarNode && v.Tag == "!!null" {
+			v.Kind, v.Tag, v.Value = yaml.MappingNode, "!!map", ""
+		}
+		return v
+	}
+	v := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, v)
+	return v
+}
+
+func setScalar(m *yaml.Node, key, value string) {
+	if v := lookup(m, key); v != nil {
+		v.Kind, v.Tag, v.Value = yaml.ScalarNode, "", value
+		return
+	}
+	m.Content = append(m.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+		&yaml.Node{Kind: yaml.ScalarNode, Value: value})
+}
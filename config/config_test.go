@@ -1,7 +1,10 @@
 package config
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -12,3 +15,134 @@ func Test_LoadConfig(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, conf)
 }
+
+func Test_FanList(t *testing.T) {
+	p := Parameters{
+		Fan:  Fan{ControlPin: "GPIO18"},
+		Fans: []Fan{{Name: "exhaust", ControlPin: "GPIO13", Input: "bmp280/temp"}},
+	}
+	assert.NoError(t, p.validate())
+	fans := p.FanList()
+	assert.Len(t, fans, 2)
+	assert.Equal(t, "GPIO18", fans[0].ControlPin)
+	assert.Equal(t, "exhaust", fans[1].Name)
+
+	p.Fans = append(p.Fans, Fan{Name: "exhaust"})
+	assert.Error(t, p.validate())
+	p.Fans = []Fan{{ControlPin: "GPIO13"}}
+	assert.Error(t, p.validate())
+
+	assert.Empty(t, (&Parameters{}).FanList())
+}
+
+func Test_Profiles(t *testing.T) {
+	f := Fan{ControlPin: "GPIO18", High: 48, Low: 40, Policy: "hysteresis"}
+	quiet := Profile{Name: "quiet", From: "22:00", To: "07:00", Tuning: Tuning{High: 55, MaxDuty: 40, PID: &PID{Setpoint: 55}}}
+	pf := f.WithTuning(quiet.Tuning)
+	assert.Equal(t, 55, pf.High)
+	assert.Equal(t, 40, pf.Low)
+	assert.Equal(t, "hysteresis", pf.Policy)
+	assert.Equal(t, 55, pf.PID.Setpoint)
+
+	from, to, err := quiet.Window()
+	assert.NoError(t, err)
+	assert.Equal(t, 22*60, from)
+	assert.Equal(t, 7*60, to)
+	days, err := quiet.Weekdays()
+	assert.NoError(t, err)
+	assert.Len(t, days, 7)
+
+	p := Parameters{Fan: f}
+	p.Fan.Profiles = []Profile{quiet}
+	assert.NoError(t, p.validate())
+	p.Fan.Profiles = []Profile{{Name: "bad", From: "25:00", To: "07:00"}}
+	assert.Error(t, p.validate())
+	p.Fan.Profiles = []Profile{{Name: "bad", From: "07:00", To: "07:00"}}
+	assert.ErrorContains(t, p.validate(), "is empty")
+	p.Fan.Profiles = []Profile{{Name: "bad", From: "22:00", To: "07:00", Days: []string{"funday"}}}
+	assert.Error(t, p.validate())
+	p.Fan.Profiles = []Profile{{From: "22:00", To: "07:00"}}
+	assert.Error(t, p.validate())
+
+	p.Fan.Profiles = nil
+	p.Fan.Shadow = []Shadow{{Name: "pid", Tuning: Tuning{Policy: "pid"}}, {Name: "pid"}}
+	assert.Error(t, p.validate())
+}
+
+func Test_PIDSetpoint(t *testing.T) {
+	p := Parameters{Fan: Fan{ControlPin: "GPIO18", Policy: "pid", PID: PID{Kp: 5}}}
+	assert.NoError(t, p.validate(), "high is suggested from trip points")
+	assert.ErrorContains(t, ValidatePID(p.Fan), "setpoint", "unless there are none")
+	p.Fan.Input = "bmp280/temp"
+	assert.ErrorContains(t, p.validate(), "setpoint", "module topic has no trip points")
+	p.Fan.Input = ""
+	p.Fan.Low = 40
+	assert.ErrorContains(t, p.validate(), "setpoint", "thresholds aren't suggested if one is set")
+	p.Fan.Low = 0
+	p.Fan.High = 50
+	assert.NoError(t, p.validate())
+	p.Fan.PID.Setpoint = 45
+	p.Fan.High = 0
+	assert.NoError(t, p.validate())
+
+	// profile and shadow switching to PID need a setpoint too
+	p = Parameters{Fan: Fan{ControlPin: "GPIO18", Policy: "curve", Low: 40}}
+	p.Fan.Profiles = []Profile{{Name: "night", From: "22:00", To: "07:00", Tuning: Tuning{Policy: "pid"}}}
+	assert.ErrorContains(t, p.validate(), "profile night")
+	p.Fan.Profiles = nil
+	p.Fan.Shadow = []Shadow{{Name: "pid", Tuning: Tuning{Policy: "pid", PID: &PID{Setpoint: 45}}}}
+	assert.NoError(t, p.validate())
+}
+
+func Test_SaveTuning(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "config.yml")
+	conf := "fan:\n  tachPin: GPIO15\n  policy: pid\n  high: 48 # summer\n  low: 40\nfans:\n  - name: exhaust\n    controlPin: GPIO13\n"
+	assert.NoError(t, os.WriteFile(fname, []byte(conf), 0o600))
+
+	err := SaveTuning(fname, "", Tuning{High: 50, Low: 43, PID: &PID{Setpoint: 46, Kp: 12.5, Ki: 0.1}})
+	assert.NoError(t, err)
+	bak, err := os.ReadFile(fname + ".bak")
+	assert.NoError(t, err)
+	assert.Equal(t, conf, string(bak))
+	err = SaveTuning(fname, "exhaust", Tuning{High: 35, Low: 30, PID: &PID{Setpoint: 32, Kp: 10}})
+	assert.NoError(t, err)
+	assert.Error(t, SaveTuning(fname, "intake", Tuning{High: 35}))
+
+	p, err := NewConfig(fname)
+	assert.NoError(t, err)
+	assert.Equal(t, "GPIO15", p.Fan.TachPin)
+	assert.Equal(t, 50, p.Fan.High)
+	assert.Equal(t, 43, p.Fan.Low)
+	assert.Equal(t, PID{Setpoint: 46, Kp: 12.5, Ki: 0.1}, p.Fan.PID)
+	assert.Equal(t, 35, p.Fans[0].High)
+	assert.Equal(t, "GPIO13", p.Fans[0].ControlPin)
+	assert.Equal(t, PID{}, p.Fans[0].PID, "hysteresis fan gets no pid section")
+
+	data, err := os.ReadFile(fname)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "high: 50 # summer")
+}
+
+func Test_Hysteresis(t *testing.T) {
+	h := Hysteresis{Spike: 15}.WithDefaults()
+	assert.Equal(t, Hysteresis{Spike: 15, Rise: 5, Settle: 1, Decline: 2, Drop: 4}, h)
+}
+
+func Test_Retention(t *testing.T) {
+	r := Retention{Hourly: time.Hour}.WithDefaults()
+	assert.Equal(t, 30*24*time.Hour, r.Raw)
+	assert.Equal(t, time.Hour, r.Hourly)
+	assert.Equal(t, time.Duration(0), r.Daily)
+}
+
+func Test_History(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "config.yml")
+	assert.NoError(t, os.WriteFile(fname, []byte("history:\n  seconds: 30m\n"), 0o600))
+	p, err := NewConfig(fname)
+	assert.NoError(t, err)
+	h := p.History.WithDefaults()
+	assert.Equal(t, 30*time.Minute, h.Seconds)
+	assert.Equal(t, 7*24*time.Hour, h.Minutes)
+	assert.Equal(t, 7*24*time.Hour, h.WarmStart)
+	assert.Equal(t, 6*time.Hour, History{WarmStart: 6 * time.Hour}.WithDefaults().WarmStart)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/parMaster/rpid/config"
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/physic"
+)
+
+const (
+	defaultPWMFrequency = 25000 // Hz, standard for 4-pin PC fans
+	softPWMMaxFrequency = 100   // Hz, software PWM can't do better than that reliably
+	kickStartTime       = time.Second
+)
+
+// FanActuator drives the fan. Duty is in percents: 0 - stopped, 100 - full speed
+type FanActuator interface {
+	SetDuty(duty int) error
+	Duty() int
+	// Halt leaves the fan running at full speed and releases the pin
+	Halt() error
+}
+
+// NewFanActuator returns the actuator for the configured fan mode
+func NewFanActuator(pin gpio.PinIO, cfg config.Fan) (FanActuator, error) {
+	switch cfg.Mode {
+	case "", "onoff":
+		return &onOffFan{pin: pin}, nil
+	case "pwm":
+		return newPWMFan(pin, cfg.PWM), nil
+	default:
+		return nil, fmt.Errorf("fan mode %s is not supported", cfg.Mode)
+	}
+}
+
+// onOffFan switches the fan fully on or off
+type onOffFan struct {
+	pin  gpio.PinIO
+	duty int
+	mx   sync.Mutex
+}
+
+func (f *onOffFan) SetDuty(duty int) error {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	state := duty > 0
+	if err := f.pin.Out(gpio.Level(state)); err != nil {
+		return fmt.Errorf("changing fan state (%v): %w", state, err)
+	}
+	f.duty = 0
+	if state {
+		f.duty = 100
+	}
+	return nil
+}
+
+func (f *onOffFan) Duty() int {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	return f.duty
+}
+
+func (f *onOffFan) Halt() error {
+	f.SetDuty(100)
+	return f.pin.Halt()
+}
+
+// pwmFan drives the fan with hardware PWM if the pin supports it
+// (GPIO12, GPIO13, GPIO18, GPIO19 on Raspberry Pi), software PWM otherwise
+type pwmFan struct {
+	pin      gpio.PinIO
+	cfg      config.PWM
+	freq     physic.Frequency
+	duty     int
+	soft     bool
+	softDuty chan int
+	softDone chan struct{}
+	softExit chan struct{}
+	kickTime time.Duration
+	kick     *time.Timer // drops kick-start duty to the requested one, nil if not kicking
+	mx       sync.Mutex
+}
+
+func newPWMFan(pin gpio.PinIO, cfg config.PWM) *pwmFan {
+	if cfg.Frequency <= 0 {
+		cfg.Frequency = defaultPWMFrequency
+	}
+	cfg.MinDuty = clamp(cfg.MinDuty, 0, 100)
+	cfg.KickDuty = clamp(cfg.KickDuty, 0, 100)
+	return &pwmFan{
+		pin:      pin,
+		cfg:      cfg,
+		freq:     physic.Frequency(cfg.Frequency) * physic.Hertz,
+		kickTime: kickStartTime,
+	}
+}
+
+func (f *pwmFan) SetDuty(duty int) error {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	duty = clamp(duty, 0, 100)
+	if duty > 0 && duty < f.cfg.MinDuty {
+		duty = f.cfg.MinDuty // fan would stall below MinDuty
+	}
+
+	kicking := f.kick != nil
+	f.stopKick()
+
+	// stopped fan needs a kick to overcome static friction,
+	// the requested duty is set when kick-start time is over, without holding the caller
+	if (f.duty == 0 || kicking) && duty > 0 && duty < f.cfg.KickDuty && f.kickTime > 0 {
+		if err := f.out(f.cfg.KickDuty); err != nil {
+			return err
+		}
+		f.duty = duty
+		var kick *time.Timer
+		kick = time.AfterFunc(f.kickTime, func() {
+			f.mx.Lock()
+			defer f.mx.Unlock()
+			if f.kick != kick {
+				return // duty was changed meanwhile
+			}
+			f.kick = nil
+			if err := f.out(f.duty); err != nil {
+				log.Printf("[ERROR] Setting duty %d after kick-start: %v", f.duty, err)
+			}
+		})
+		f.kick = kick
+		return nil
+	}
+
+	if err := f.out(duty); err != nil {
+		return err
+	}
+	f.duty = duty
+	return nil
+}
+
+// stopKick cancels pending drop from kick-start duty, called with the lock held
+func (f *pwmFan) stopKick() {
+	if f.kick != nil {
+		f.kick.Stop()
+		f.kick = nil
+	}
+}
+
+func (f *pwmFan) Duty() int {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	return f.duty
+}
+
+func (f *pwmFan) Halt() error {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	f.stopKick()
+	if f.soft {
+		close(f.softDone)
+		<-f.softExit
+		f.soft = false
+	}
+	f.duty = 100
+	if err := f.pin.Out(gpio.High); err != nil {
+		return err
+	}
+	return f.pin.Halt()
+}
+
+// out sets the duty on the pin, falls back to software PWM if hardware PWM fails
+func (f *pwmFan) out(duty int) error {
+	if f.soft {
+		f.setSoftDuty(duty)
+		return nil
+	}
+	err := f.pin.PWM(gpio.DutyMax*gpio.Duty(duty)/100, f.freq)
+	if err == nil {
+		return nil
+	}
+	log.Printf("[WARN] Hardware PWM is not available on %s (%v), using software PWM", f.pin, err)
+	f.startSoftPWM()
+	f.setSoftDuty(duty)
+	return nil
+}
+
+// setSoftDuty replaces the pending duty, if software PWM loop hasn't picked it up yet
+func (f *pwmFan) setSoftDuty(duty int) {
+	select {
+	case <-f.softDuty:
+	default:
+	}
+	f.softDuty <- duty
+}
+
+func (f *pwmFan) startSoftPWM() {
+	f.soft = true
+	f.softDuty = make(chan int, 1)
+	f.softDone = make(chan struct{})
+	f.softExit = make(chan struct{})
+
+	freq := min(f.cfg.Frequency, softPWMMaxFrequency)
+	go func() {
+		softPWM(f.pin, time.Second/time.Duration(freq), f.softDuty, f.softDone)
+		close(f.softExit)
+	}()
+}
+
+// softPWM toggles the pin in a loop, until done is closed
+func softPWM(pin gpio.PinOut, period time.Duration, dutyCh <-chan int, done <-chan struct{}) {
+	duty := 0
+	for {
+		select {
+		case <-done:
+			return
+		case duty = <-dutyCh:
+		default:
+		}
+
+		switch duty {
+		case 0:
+			pin.Out(gpio.Low)
+			time.Sleep(period)
+		case 100:
+			pin.Out(gpio.High)
+			time.Sleep(period)
+		default:
+			high := period * time.Duration(duty) / 100
+			pin.Out(gpio.High)
+			time.Sleep(high)
+			pin.Out(gpio.Low)
+			time.Sleep(period - high)
+		}
+	}
+}
+
+func clamp(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
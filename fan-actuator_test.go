@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/parMaster/rpid/config"
+	"github.com/stretchr/testify/assert"
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/physic"
+)
+
+// testPin records levels and PWM duties set on it
+type testPin struct {
+	gpio.PinIO
+	level  gpio.Level
+	duties []gpio.Duty
+	noPWM  bool
+	broken bool // Out fails
+}
+
+func (p *testPin) Out(l gpio.Level) error {
+	if p.broken {
+		return errors.New("broken")
+	}
+	p.level = l
+	return nil
+}
+
+func (p *testPin) PWM(d gpio.Duty, f physic.Frequency) error {
+	if p.noPWM {
+		return errors.New("not supported")
+	}
+	p.duties = append(p.duties, d)
+	return nil
+}
+
+func (p *testPin) Halt() error { return nil }
+
+func (p *testPin) String() string { return "testPin" }
+
+func Test_OnOffFan(t *testing.T) {
+	pin := &testPin{PinIO: gpio.INVALID}
+	fan, err := NewFanActuator(pin, config.Fan{})
+	assert.NoError(t, err)
+
+	assert.NoError(t, fan.SetDuty(30))
+	assert.Equal(t, gpio.High, pin.level)
+	assert.Equal(t, 100, fan.Duty())
+
+	assert.NoError(t, fan.SetDuty(0))
+	assert.Equal(t, gpio.Low, pin.level)
+	assert.Equal(t, 0, fan.Duty())
+
+	_, err = NewFanActuator(pin, config.Fan{Mode: "turbo"})
+	assert.Error(t, err)
+}
+
+func Test_PWMFan(t *testing.T) {
+	pin := &testPin{PinIO: gpio.INVALID}
+	fan := newPWMFan(pin, config.PWM{MinDuty: 20, KickDuty: 60})
+	fan.kickTime = 0
+
+	// below MinDuty is raised to MinDuty
+	assert.NoError(t, fan.SetDuty(10))
+	assert.Equal(t, 20, fan.Duty())
+	assert.Equal(t, gpio.DutyMax*20/100, pin.duties[len(pin.duties)-1])
+
+	assert.NoError(t, fan.SetDuty(150))
+	assert.Equal(t, 100, fan.Duty())
+
+	assert.NoError(t, fan.SetDuty(0))
+	assert.Equal(t, 0, fan.Duty())
+
+	// kick-start from stopped state doesn't block, requested duty follows
+	fan.kickTime = 50 * time.Millisecond
+	pin.duties = nil
+	assert.NoError(t, fan.SetDuty(30))
+	assert.Equal(t, 30, fan.Duty())
+	duties := func() []gpio.Duty {
+		fan.mx.Lock()
+		defer fan.mx.Unlock()
+		return append([]gpio.Duty{}, pin.duties...)
+	}
+	assert.Equal(t, []gpio.Duty{gpio.DutyMax * 60 / 100}, duties())
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]gpio.Duty{gpio.DutyMax * 60 / 100, gpio.DutyMax * 30 / 100}, duties())
+	}, time.Second, 10*time.Millisecond)
+
+	// duty changed while kicking cancels the pending one
+	assert.NoError(t, fan.SetDuty(0))
+	pin.duties = nil
+	assert.NoError(t, fan.SetDuty(30))
+	assert.NoError(t, fan.SetDuty(100))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, []gpio.Duty{gpio.DutyMax * 60 / 100, gpio.DutyMax}, duties())
+	assert.Equal(t, 100, fan.Duty())
+
+	assert.NoError(t, fan.Halt())
+	assert.Equal(t, gpio.High, pin.level)
+	assert.Equal(t, 100, fan.Duty())
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/parMaster/rpid/config"
+	"periph.io/x/host/v3"
+)
+
+// how long each autotune step lasts by default, CPU takes a few minutes to settle
+const defaultAutotuneSettle = 5 * time.Minute
+
+// AutotuneResult is the measured fan step response and the tuning proposed from it
+type AutotuneResult struct {
+	Fan          string
+	Running      bool
+	Started      time.Time
+	Finished     time.Time  `json:",omitempty"`
+	Error        string     `json:",omitempty"`
+	OffTemp      ShortFloat // ˚C, settled with the fan off
+	OnTemp       ShortFloat // ˚C, settled with the fan at full speed
+	Gain         ShortFloat // ˚C per duty %, negative
+	DeadTime     ShortFloat // s, before temperature starts to fall
+	TimeConstant ShortFloat // s, of the temperature fall
+	Proposed     config.Tuning
+	Saved        bool // proposed tuning is written to the config file
+}
+
+// Autotune runs the fan off and then at full speed for settle time each,
+// measures the temperature response and proposes hysteresis thresholds and PID gains.
+// Fan mode is restored afterwards
+func (c *FanController) Autotune(ctx context.Context, settle time.Duration) (res AutotuneResult, err error) {
+	if c.fan == nil {
+		return res, fmt.Errorf("no control pin defined for %s", c.Name())
+	}
+	if settle <= 0 {
+		settle = defaultAutotuneSettle
+	}
+
+	if err = c.acquire("autotune"); err != nil {
+		return res, err
+	}
+	defer c.release()
+
+	c.mx.Lock()
+	res = AutotuneResult{Fan: c.Name(), Running: true, Started: time.Now()}
+	started := res
+	c.tuning = &started
+	c.mx.Unlock()
+
+	defer func() {
+		res.Running, res.Finished = false, time.Now()
+		if err != nil {
+			res.Error = err.Error()
+		}
+		done := res
+		c.mx.Lock()
+		c.tuning = &done
+		c.mx.Unlock()
+	}()
+
+	prev := c.Override()
+	defer c.restoreOverride(ctx, prev)
+
+	log.Printf("[INFO] Autotune of %s started, %s per step", c.Name(), settle)
+	if _, err = c.setOverride(ctx, FanOff, 0, 0); err != nil {
+		return res, err
+	}
+	off, err := c.record(ctx, settle)
+	if err != nil {
+		return res, err
+	}
+	if _, err = c.setOverride(ctx, FanOn, 0, 0); err != nil {
+		return res, err
+	}
+	on, err := c.record(ctx, settle)
+	if err != nil {
+		return res, err
+	}
+
+	if err = res.analyze(off, on); err != nil {
+		return res, err
+	}
+	log.Printf("[INFO] Autotune of %s: %+v", c.Name(), res)
+	return res, nil
+}
+
+// record samples the input temperature every second for the given time, ˚C
+func (c *FanController) record(ctx context.Context, d time.Duration) ([]float64, error) {
+	var samples []float64
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for end := time.Now().Add(d); time.Now().Before(end); {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+		temp, err := c.input()
+		if err != nil {
+			return nil, fmt.Errorf("can't read %s input: %w", c.Name(), err)
+		}
+		if temp >= c.criticalTemp() {
+			return nil, errors.New("critical temperature reached")
+		}
+		samples = append(samples, float64(temp)/1000)
+	}
+	if len(samples) < 60 {
+		return nil, fmt.Errorf("not enough samples (%d), settle time is too short", len(samples))
+	}
+	return samples, nil
+}
+
+// restoreOverride returns the fan to the mode it was in before autotune or self-test
+func (c *FanController) restoreOverride(ctx context.Context, o FanOverride) {
+	var expire time.Duration
+	if !o.Until.IsZero() {
+		if expire = time.Until(o.Until); expire <= 0 {
+			o.Mode = FanAuto
+		}
+	}
+	if _, err := c.setOverride(ctx, o.Mode, o.Duty, expire); err != nil {
+		log.Printf("[ERROR] Restoring %s mode: %v", c.Name(), err)
+	}
+}
+
+// analyze fits the first order model with dead time to the fan-on step response
+// (two point method, 28% and 63% of the change) and proposes the tuning
+func (r *AutotuneResult) analyze(off, on []float64) error {
+	tail := func(s []float64) float64 {
+		sum, n := 0.0, min(30, len(s))
+		for _, v := range s[len(s)-n:] {
+			sum += v
+		}
+		return sum / float64(n)
+	}
+	offTemp, onTemp := tail(off), tail(on)
+	span := offTemp - onTemp
+	if span < 1 {
+		return fmt.Errorf("fan has no measurable effect, %.1f˚C off, %.1f˚C on", offTemp, onTemp)
+	}
+
+	// seconds since the fan was turned on until the temperature fell by the share of span
+	reached := func(share float64) float64 {
+		for i := range on {
+			lo, hi := max(0, i-2), min(len(on), i+3) // smooth sensor steps out
+			sum := 0.0
+			for _, v := range on[lo:hi] {
+				sum += v
+			}
+			if offTemp-sum/float64(hi-lo) >= share*span {
+				return float64(i + 1)
+			}
+		}
+		return float64(len(on))
+	}
+	t28, t63 := reached(0.283), reached(0.632)
+	tau := math.Max(1.5*(t63-t28), 1)
+	dead := math.Max(t63-tau, 0)
+	gain := span / 100 // ˚C per duty %
+
+	// lambda tuning of PI controller with lambda = tau, robust for slow thermal processes
+	kp := tau / (gain * (tau + dead))
+	ki := kp / tau
+
+	round := func(v float64) float64 { return math.Round(v*1000) / 1000 }
+	low := int(math.Round(onTemp + 0.25*span))
+	high := int(math.Round(onTemp + 0.6*span))
+	if high-low < 2 {
+		high = low + 2
+	}
+
+	r.OffTemp, r.OnTemp = ShortFloat(offTemp), ShortFloat(onTemp)
+	r.Gain, r.DeadTime, r.TimeConstant = ShortFloat(-gain), ShortFloat(dead), ShortFloat(tau)
+	r.Proposed = config.Tuning{High: high, Low: low, PID: &config.PID{
+		Setpoint: int(math.Round(onTemp + 0.4*span)),
+		Kp:       round(kp),
+		Ki:       round(ki),
+	}}
+	return nil
+}
+
+// Tuning returns the latest autotune result, nil if autotune never ran
+func (c *FanController) Tuning() *AutotuneResult {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.tuning == nil {
+		return nil
+	}
+	r := *c.tuning
+	return &r
+}
+
+// autotune runs fan autotune and writes the proposed tuning to the config file if asked to
+func (w *Worker) autotune(ctx context.Context, f *FanController, settle time.Duration, save bool) (AutotuneResult, error) {
+	res, err := f.Autotune(ctx, settle)
+	if err != nil || !save {
+		return res, err
+	}
+	if err = config.SaveTuning(w.config.File, f.cfg.Name, res.Proposed); err != nil {
+		return res, err
+	}
+	log.Printf("[INFO] Autotune of %s saved to %s", f.Name(), w.config.File)
+	res.Saved = true
+	f.mx.Lock()
+	f.tuning.Saved = true
+	f.mx.Unlock()
+	return res, nil
+}
+
+// autotuneRequest is the POST /fan/autotune body
+type autotuneRequest struct {
+	Fan    string `json:"fan"`    // fan name, the first fan if empty
+	Settle string `json:"settle"` // step duration, like 5m
+	Save   bool   `json:"save"`   // write proposed tuning to the config file
+}
+
+// startAutotune handles POST /fan/autotune, autotune runs in background
+func (w *Worker) startAutotune(rw http.ResponseWriter, r *http.Request) {
+	var req autotuneRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f := w.fanByName(req.Fan)
+	if f == nil {
+		http.Error(rw, fmt.Sprintf("fan %q not found", req.Fan), http.StatusNotFound)
+		return
+	}
+	var settle time.Duration
+	if req.Settle != "" {
+		var err error
+		if settle, err = time.ParseDuration(req.Settle); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if job := f.Busy(); job != "" {
+		http.Error(rw, fmt.Sprintf("%s of %s is running", job, f.Name()), http.StatusConflict)
+		return
+	}
+
+	go func() {
+		if _, err := w.autotune(w.ctx, f, settle, req.Save); err != nil {
+			log.Printf("[ERROR] Autotune of %s: %v", f.Name(), err)
+		}
+	}()
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+// autotuneResults handles GET /fan/autotune, returns the latest autotune results by fan
+func (w *Worker) autotuneResults(rw http.ResponseWriter, r *http.Request) {
+	out := map[string]*AutotuneResult{}
+	for _, f := range w.fans {
+		out[f.Name()] = f.Tuning()
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(out)
+}
+
+// AutotuneCmd runs autotune of one fan from the command line
+type AutotuneCmd struct {
+	Fan    string        `long:"fan" description:"fan name, fan section by default"`
+	Settle time.Duration `long:"settle" default:"5m" description:"duration of each step"`
+	Save   bool          `long:"save" description:"write proposed tuning to the config file"`
+}
+
+// Run runs autotune driving the fan alone, without the service loops and HTTP server,
+// and prints the result. It refuses to run next to the service, both would drive the same fan
+func (cmd *AutotuneCmd) Run(ctx context.Context, conf *config.Parameters, out io.Writer) error {
+	// holding the service address also keeps the service from starting meanwhile
+	ln, err := net.Listen("tcp", conf.Server.Listen)
+	if err != nil {
+		return fmt.Errorf("rpid seems to be running (%s is in use), stop it or use POST /fan/autotune: %w", conf.Server.Listen, err)
+	}
+	defer ln.Close()
+
+	var cfg *config.Fan
+	for _, f := range conf.FanList() {
+		if f.Name == cmd.Fan {
+			cfg = &f
+			break
+		}
+	}
+	if cfg == nil {
+		return fmt.Errorf("fan %q is not configured", cmd.Fan)
+	}
+	if strings.Contains(cfg.Input, "/") {
+		return fmt.Errorf("fan %q follows module input %s, collected by the service only, use POST /fan/autotune", cmd.Fan, cfg.Input)
+	}
+
+	if _, err = host.Init(); err != nil {
+		return err
+	}
+	w := NewWorker(conf)
+	fan := w.suggestThresholds(*cfg)
+	f, err := NewFanController(fan, w.fanInput(fan), nil, w.sysfs(), conf.History)
+	if err != nil {
+		return err
+	}
+	if f.fan != nil {
+		defer func() {
+			if err := f.fan.Halt(); err != nil {
+				log.Printf("[ERROR] Halting %s: %v", f.Name(), err)
+			}
+		}()
+	}
+
+	res, err := w.autotune(ctx, f, cmd.Settle, cmd.Save)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, string(data))
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parMaster/rpid/config"
+	"github.com/stretchr/testify/assert"
+	"periph.io/x/conn/v3/gpio"
+)
+
+func Test_AutotuneAnalyze(t *testing.T) {
+	// first order response from 65˚C to 45˚C, 60s time constant, 10s dead time
+	off := make([]float64, 300)
+	on := make([]float64, 600)
+	m := &thermalModel{ambient: 25, heat: 40, cooling: 0.5, tau: time.Minute, temp: 65}
+	for i := range off {
+		off[i] = m.Step(time.Second, 0)
+	}
+	for i := range on {
+		duty := 100
+		if i < 10 {
+			duty = 0
+		}
+		on[i] = m.Step(time.Second, duty)
+	}
+
+	var r AutotuneResult
+	assert.NoError(t, r.analyze(off, on))
+	assert.InDelta(t, 65, float64(r.OffTemp), 0.1)
+	assert.InDelta(t, 45, float64(r.OnTemp), 0.1)
+	assert.InDelta(t, -0.2, float64(r.Gain), 0.01)
+	assert.InDelta(t, 60, float64(r.TimeConstant), 5)
+	assert.InDelta(t, 10, float64(r.DeadTime), 5)
+	assert.Equal(t, 50, r.Proposed.Low)
+	assert.Equal(t, 57, r.Proposed.High)
+	assert.Equal(t, 53, r.Proposed.PID.Setpoint)
+	assert.InDelta(t, 4.3, r.Proposed.PID.Kp, 0.3)
+
+	assert.Error(t, r.analyze(off, off))
+}
+
+func Test_Autotune(t *testing.T) {
+	pin := &testPin{PinIO: gpio.INVALID}
+	policy, err := NewFanPolicy(config.Fan{High: 48, Low: 40})
+	assert.NoError(t, err)
+	c := &FanController{
+		input:  func() (int, error) { return 50000, nil },
+		fan:    &onOffFan{pin: pin},
+		policy: policy,
+		data:   testHistory(),
+	}
+	ctx := context.Background()
+	_, err = c.SetOverride(ctx, FanDuty, 30, 0)
+	assert.NoError(t, err)
+
+	// too short to measure anything, mode is restored anyway
+	_, err = c.Autotune(ctx, time.Second)
+	assert.Error(t, err)
+	assert.Equal(t, FanDuty, c.Override().Mode)
+	assert.Equal(t, 30, c.Override().Duty)
+	assert.False(t, c.Tuning().Running)
+	assert.Contains(t, c.Tuning().Error, "not enough samples")
+
+	// manual mode is locked out while autotune runs
+	w := &Worker{fans: []*FanController{c}}
+	assert.NoError(t, c.acquire("autotune"))
+	rec := httptest.NewRecorder()
+	w.setFanOverride(rec, httptest.NewRequest("POST", "/fan", strings.NewReader(`{"mode":"on"}`)))
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Equal(t, FanDuty, c.Override().Mode)
+	_, err = c.SetOverride(ctx, FanOn, 0, 0)
+	assert.ErrorIs(t, err, ErrFanBusy)
+	c.release()
+
+	// autotune doesn't start while self-test runs
+	assert.NoError(t, c.acquire("self-test"))
+	_, err = c.Autotune(ctx, time.Second)
+	assert.ErrorIs(t, err, ErrFanBusy)
+	rec = httptest.NewRecorder()
+	w.startAutotune(rec, httptest.NewRequest("POST", "/fan/autotune", strings.NewReader(`{}`)))
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	c.release()
+}
+
+func Test_AutotuneCmd(t *testing.T) {
+	// the service is listening, autotune would fight it over the fan
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	conf := &config.Parameters{Server: config.Server{Listen: ln.Addr().String()}}
+	err = (&AutotuneCmd{}).Run(context.Background(), conf, io.Discard)
+	assert.ErrorContains(t, err, "seems to be running")
+
+	conf.Server.Listen = "127.0.0.1:0"
+	err = (&AutotuneCmd{Fan: "exhaust"}).Run(context.Background(), conf, io.Discard)
+	assert.ErrorContains(t, err, "not configured")
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/parMaster/rpid/config"
+)
+
+// CurvePolicy maps temperature to fan duty with a piecewise-linear curve, like BIOS fan curves do
+//
+// Input temperature follows the measured one only after it rises by more than Rise
+// or falls by more than Fall ˚C, so the fan doesn't hunt around a curve point
+type CurvePolicy struct {
+	cfg    config.Curve
+	mx     sync.Mutex
+	state  CurveState
+	primed bool // state.Temp is set
+}
+
+// CurveState is the curve and the current operating point on it, reported to /fullData
+type CurveState struct {
+	Points []config.CurvePoint
+	Input  string
+	Temp   ShortFloat // ˚C, operating point
+	Duty   int        // %, operating point
+}
+
+func NewCurvePolicy(cfg config.Curve) (*CurvePolicy, error) {
+	if len(cfg.Points) == 0 {
+		return nil, fmt.Errorf("curve policy needs at least one point")
+	}
+	points := append([]config.CurvePoint{}, cfg.Points...)
+	sort.Slice(points, func(i, j int) bool { return points[i].Temp < points[j].Temp })
+	for i := range points {
+		points[i].Duty = clamp(points[i].Duty, 0, 100)
+	}
+	cfg.Points = points
+
+	switch cfg.Input {
+	case "":
+		cfg.Input = "30s"
+	case "10s", "30s", "1m":
+	default:
+		return nil, fmt.Errorf("curve input %s is not supported, use 10s, 30s or 1m", cfg.Input)
+	}
+
+	return &CurvePolicy{cfg: cfg, state: CurveState{Points: points, Input: cfg.Input}}, nil
+}
+
+func (p *CurvePolicy) Name() string {
+	return "curve"
+}
+
+func (p *CurvePolicy) Period() time.Duration {
+	return 10 * time.Second
+}
+
+func (p *CurvePolicy) Decide(h TempHistory) FanDecision {
+	var input int
+	switch p.cfg.Input {
+	case "10s":
+		input = avg(h.Seconds[max(0, len(h.Seconds)-10):])
+	case "30s":
+		input = avg(h.Seconds[max(0, len(h.Seconds)-30):])
+	case "1m":
+		input = last(h.Minutes)
+	}
+	if input == 0 {
+		return FanDecision{Duty: 100, Rule: "no data"}
+	}
+	temp := float64(input) / 1000
+
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	d := FanDecision{Keep: true, Inputs: map[string]int{"ma" + p.cfg.Input: input}}
+	switch {
+	case !p.primed:
+		d.Rule = "start"
+	case temp >= float64(p.state.Temp)+p.cfg.Rise:
+		d.Rule = "rising"
+	case temp <= float64(p.state.Temp)-p.cfg.Fall:
+		d.Rule = "falling"
+	default:
+		return d
+	}
+
+	p.primed = true
+	p.state.Temp = ShortFloat(temp)
+	p.state.Duty = p.dutyAt(temp)
+	d.Keep, d.Duty = false, p.state.Duty
+	return d
+}
+
+// dutyAt interpolates the curve at the given temperature
+func (p *CurvePolicy) dutyAt(temp float64) int {
+	pts := p.cfg.Points
+	if temp <= pts[0].Temp {
+		return pts[0].Duty
+	}
+	for i := 1; i < len(pts); i++ {
+		if temp <= pts[i].Temp {
+			a, b := pts[i-1], pts[i]
+			k := (temp - a.Temp) / (b.Temp - a.Temp)
+			return int(math.Round(float64(a.Duty) + k*float64(b.Duty-a.Duty)))
+		}
+	}
+	return pts[len(pts)-1].Duty
+}
+
+func (p *CurvePolicy) Report() interface{} {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return p.state
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/parMaster/rpid/storage/model"
+)
+
+// how many events each fan keeps in memory
+const fanEventsLimit = 200
+
+// FanEvent is the fan state transition: duty change by policy, fault or mode change
+type FanEvent struct {
+	Time time.Time
+	Fan  string
+	// Kind is one of:
+	//  - decision: duty change by the policy, critical temperature, safe mode or override
+	//  - fault: stall, spinning while off, recovered, or the failed self-test entering safe mode.
+	//    Kick-start after the stall fault isn't an event, it's in the log only
+	//  - override: manual mode set, reset to auto or expired
+	//  - profile: active profile change
+	//  - shadow: duty change by the shadow policy, the fan isn't driven by it
+	//  - maintenance: running hours alert or stats reset
+	Kind   string
+	Rule   string         // policy rule, fault, mode or profile name
+	Duty   int            // % after the event
+	Inputs map[string]int `json:",omitempty"` // values the decision was based on
+	// duty % added by feed-forward, included in Duty
+	FeedForward int `json:",omitempty"`
+}
+
+// event logs and records the fan event, both in memory and in storage
+func (c *FanController) event(ctx context.Context, e FanEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Fan = c.Name()
+	log.Printf("[INFO] %s %s: %s, duty %d%% %v", e.Fan, e.Kind, e.Rule, e.Duty, e.Inputs)
+
+	c.mx.Lock()
+	c.events = append(c.events, e)
+	if len(c.events) > fanEventsLimit {
+		c.events = c.events[len(c.events)-fanEventsLimit:]
+	}
+	c.mx.Unlock()
+
+	if c.store == nil {
+		return
+	}
+	value, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal %s event: %v", e.Fan, err)
+		return
+	}
+	if err := c.store.Write(ctx, model.Data{Module: "fan", Time: e.Time, Topic: c.topic(e.Kind), Text: string(value)}); err != nil {
+		log.Printf("[ERROR] Failed to store %s %s: %v", e.Fan, e.Kind, err)
+	}
+}
+
+// Events returns the recent fan events, oldest first
+func (c *FanController) Events() []FanEvent {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return append([]FanEvent{}, c.events...)
+}
+
+// fanEvents handles GET /fan/events, returns recent events of all fans, oldest first
+func (w *Worker) fanEvents(rw http.ResponseWriter, r *http.Request) {
+	out := []FanEvent{}
+	for _, f := range w.fans {
+		out = append(out, f.Events()...)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(rw).Encode(out)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/parMaster/rpid/config"
+)
+
+// cpuStat measures CPU utilisation between reads of /proc/stat
+// https://www.kernel.org/doc/html/latest/filesystems/proc.html#miscellaneous-kernel-statistics-in-proc-stat
+type cpuStat struct {
+	path        string
+	idle, total uint64 // jiffies at the previous read
+}
+
+func newCPUStat() *cpuStat {
+	return &cpuStat{path: "/proc/stat"}
+}
+
+// Utilisation returns busy CPU time share since the previous call, %
+func (s *cpuStat) Utilisation() (int, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return 0, fmt.Errorf("%s is empty", s.path)
+	}
+	fields := strings.Fields(scanner.Text())
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, fmt.Errorf("unexpected %s format: %s", s.path, scanner.Text())
+	}
+	var idle, total uint64
+	for i, v := range fields[1:] {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("unexpected %s format: %w", s.path, err)
+		}
+		total += n
+		if i == 3 || i == 4 { // idle and iowait
+			idle += n
+		}
+	}
+
+	dIdle, dTotal := idle-s.idle, total-s.total
+	primed := s.total > 0
+	s.idle, s.total = idle, total
+	if !primed || dTotal == 0 {
+		return 0, nil
+	}
+	return int(100 * (dTotal - dIdle) / dTotal), nil
+}
+
+// feedForwardPolicy adds duty proportional to CPU utilisation to the decision of the wrapped policy,
+// so the fan speeds up with the load, not after the temperature follows it
+type feedForwardPolicy struct {
+	FanPolicy
+	cfg  config.FeedForward
+	mx   sync.Mutex
+	base int // latest duty the wrapped policy decided on
+}
+
+func newFeedForwardPolicy(p FanPolicy, cfg config.FeedForward) *feedForwardPolicy {
+	if cfg.Window <= 0 {
+		cfg.Window = 5
+	}
+	return &feedForwardPolicy{FanPolicy: p, cfg: cfg}
+}
+
+func (p *feedForwardPolicy) Decide(h TempHistory) FanDecision {
+	d := p.FanPolicy.Decide(h)
+
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	if !d.Keep {
+		p.base = d.Duty
+	}
+	if len(h.Load) == 0 {
+		return d // no load data, wrapped policy decides alone
+	}
+
+	load := avg(h.Load[max(0, len(h.Load)-p.cfg.Window):])
+	d.FeedForward = int(math.Round(p.cfg.Gain * float64(max(0, load-p.cfg.Threshold))))
+	if d.Inputs == nil {
+		d.Inputs = map[string]int{}
+	}
+	d.Inputs["load"] = load
+
+	// output is recalculated every time, so the fan follows the load down as well
+	d.Keep, d.Duty = false, clamp(p.base+d.FeedForward, 0, 100)
+	d.FeedForward = max(0, d.Duty-p.base) // contribution left after clamping
+	if d.Rule == "" {
+		d.Rule = "feed-forward"
+	}
+	return d
+}
+
+// capDecision lowers the decided duty to maxDuty, feed-forward contribution is cut first
+func capDecision(d FanDecision, maxDuty int) FanDecision {
+	if d.Duty <= maxDuty {
+		return d
+	}
+	d.FeedForward = max(0, d.FeedForward-(d.Duty-maxDuty))
+	d.Duty = maxDuty
+	return d
+}
+
+// Unwrap returns the wrapped policy
+func (p *feedForwardPolicy) Unwrap() FanPolicy {
+	return p.FanPolicy
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	FanAuto = "auto" // fan is driven by its policy
+	FanOn   = "on"   // fan is forced on at full speed
+	FanOff  = "off"  // fan is forced off
+	FanDuty = "duty" // fan is forced to the fixed duty
+)
+
+// FanOverride is the manual fan mode, set through the API
+type FanOverride struct {
+	Mode  string    `json:"mode"`
+	Duty  int       `json:"duty"`
+	Until time.Time `json:"until,omitempty"` // zero for no expiry
+}
+
+// ErrFanBusy is returned while autotune or self-test drives the fan
+var ErrFanBusy = errors.New("fan is busy")
+
+// Expired reports if the override is over at the given time
+func (o FanOverride) Expired(now time.Time) bool {
+	return !o.Until.IsZero() && !now.Before(o.Until)
+}
+
+// SetOverride forces the fan to the mode for the given time (0 for no expiry),
+// auto mode returns the fan to its policy. Fails with ErrFanBusy while autotune or self-test runs
+func (c *FanController) SetOverride(ctx context.Context, mode string, duty int, expire time.Duration) (FanOverride, error) {
+	if job := c.Busy(); job != "" {
+		return FanOverride{}, fmt.Errorf("%s of %s is running: %w", job, c.Name(), ErrFanBusy)
+	}
+	return c.setOverride(ctx, mode, duty, expire)
+}
+
+// setOverride sets the mode, for autotune and self-test holding the fan too
+func (c *FanController) setOverride(ctx context.Context, mode string, duty int, expire time.Duration) (FanOverride, error) {
+	if c.fan == nil {
+		return FanOverride{}, fmt.Errorf("no control pin defined for %s", c.Name())
+	}
+	if expire < 0 {
+		return FanOverride{}, fmt.Errorf("negative expiry %s", expire)
+	}
+
+	o := FanOverride{Mode: mode, Duty: duty}
+	switch mode {
+	case FanAuto:
+		o.Duty = 0
+		c.mx.Lock()
+		c.override = nil
+		c.mx.Unlock()
+		c.event(ctx, FanEvent{Kind: "override", Rule: FanAuto, Duty: c.Duty()})
+		return o, nil
+	case FanOn:
+		o.Duty = 100
+	case FanOff:
+		o.Duty = 0
+	case FanDuty:
+		if duty < 0 || duty > 100 {
+			return FanOverride{}, fmt.Errorf("duty %d%% is out of 0-100 range", duty)
+		}
+	default:
+		return FanOverride{}, fmt.Errorf("unknown mode %q, use auto, on, off or duty", mode)
+	}
+	if expire > 0 {
+		o.Until = time.Now().Add(expire).Truncate(time.Second)
+	}
+
+	c.mx.Lock()
+	prev := c.override
+	c.override = &o
+	c.mx.Unlock()
+
+	// critical temperature and safe mode keep the fan at full speed, override applies after them
+	if _, hot := c.critical(); !hot && !c.safeMode() {
+		if err := c.setDuty(o.Duty); err != nil {
+			c.mx.Lock()
+			c.override = prev
+			c.mx.Unlock()
+			return o, err
+		}
+	}
+	rule := o.Mode
+	if !o.Until.IsZero() {
+		rule += " until " + o.Until.Format(time.RFC3339)
+	}
+	c.event(ctx, FanEvent{Kind: "override", Rule: rule, Duty: o.Duty})
+	return o, nil
+}
+
+// acquire marks the fan busy with the job, autotune or self-test, unless another one runs
+func (c *FanController) acquire(job string) error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.busy != "" {
+		return fmt.Errorf("%s of %s is running: %w", c.busy, c.Name(), ErrFanBusy)
+	}
+	c.busy = job
+	return nil
+}
+
+// release ends the job started with acquire
+func (c *FanController) release() {
+	c.mx.Lock()
+	c.busy = ""
+	c.mx.Unlock()
+}
+
+// Busy returns the job driving the fan, autotune or self-test, empty if there is none
+func (c *FanController) Busy() string {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.busy
+}
+
+// Override returns the current manual mode, auto if there is none
+func (c *FanController) Override() FanOverride {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.override == nil {
+		return FanOverride{Mode: FanAuto}
+	}
+	return *c.override
+}
+
+// activeOverride returns the current override or nil, dropping it once expired
+func (c *FanController) activeOverride(ctx context.Context, now time.Time) *FanOverride {
+	c.mx.Lock()
+	o := c.override
+	if o != nil && o.Expired(now) {
+		c.override = nil
+	}
+	c.mx.Unlock()
+
+	if o != nil && o.Expired(now) {
+		c.event(ctx, FanEvent{Time: now, Kind: "override", Rule: FanAuto + " (expired)", Duty: c.Duty()})
+		return nil
+	}
+	return o
+}
+
+// fanRequest is the POST /fan body
+type fanRequest struct {
+	Fan    string `json:"fan"`    // fan name, the first fan if empty
+	Mode   string `json:"mode"`   // auto, on, off or duty
+	Duty   int    `json:"duty"`   // % for duty mode
+	Expire string `json:"expire"` // duration, like 30m, no expiry if empty
+}
+
+// fanByName returns the fan by name, the first one if name is empty
+func (w *Worker) fanByName(name string) *FanController {
+	for _, f := range w.fans {
+		if name == "" || f.Name() == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// fanOverrides handles GET /fan, returns manual modes of all fans
+func (w *Worker) fanOverrides(rw http.ResponseWriter, r *http.Request) {
+	out := map[string]FanOverride{}
+	for _, f := range w.fans {
+		out[f.Name()] = f.Override()
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(out)
+}
+
+// setFanOverride handles POST /fan
+func (w *Worker) setFanOverride(rw http.ResponseWriter, r *http.Request) {
+	var req fanRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f := w.fanByName(req.Fan)
+	if f == nil {
+		http.Error(rw, fmt.Sprintf("fan %q not found", req.Fan), http.StatusNotFound)
+		return
+	}
+	var expire time.Duration
+	if req.Expire != "" {
+		var err error
+		if expire, err = time.ParseDuration(req.Expire); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	o, err := f.SetOverride(r.Context(), req.Mode, req.Duty, expire)
+	if errors.Is(err, ErrFanBusy) {
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("[WARN] %s override rejected: %v", f.Name(), err)
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(o)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/parMaster/rpid/config"
+)
+
+// PIDPolicy holds the temperature at the setpoint by adjusting fan duty
+//
+// Derivative is taken on measurement (not on error) to avoid kicks on setpoint change
+// and is low-pass filtered, integral is clamped to the output range (anti-windup)
+type PIDPolicy struct {
+	cfg    config.PID
+	period time.Duration
+	mx     sync.Mutex
+	state  PIDState
+	prev   float64 // previous measurement, ˚C
+	primed bool    // prev is set
+}
+
+// PIDState is the latest controller state, reported to /fullData for tuning
+type PIDState struct {
+	Setpoint ShortFloat // ˚C
+	Temp     ShortFloat // ˚C
+	Error    ShortFloat // ˚C, positive when hotter than setpoint
+	P        ShortFloat // proportional term, duty %
+	I        ShortFloat // integral term, duty %
+	D        ShortFloat // derivative term, duty %
+	Output   ShortFloat // clamped sum of terms, duty %
+}
+
+func NewPIDPolicy(cfg config.PID) *PIDPolicy {
+	if cfg.Period <= 0 {
+		cfg.Period = 5
+	}
+	if cfg.MaxDuty <= 0 || cfg.MaxDuty > 100 {
+		cfg.MaxDuty = 100
+	}
+	cfg.MinDuty = clamp(cfg.MinDuty, 0, cfg.MaxDuty)
+	cfg.DFilter = math.Max(0, math.Min(cfg.DFilter, 0.99))
+	return &PIDPolicy{
+		cfg:    cfg,
+		period: time.Duration(cfg.Period) * time.Second,
+	}
+}
+
+func (p *PIDPolicy) Name() string {
+	return "pid"
+}
+
+func (p *PIDPolicy) Period() time.Duration {
+	return p.period
+}
+
+func (p *PIDPolicy) Decide(h TempHistory) FanDecision {
+	if len(h.Seconds) == 0 {
+		return FanDecision{Duty: 100, Rule: "no data"}
+	}
+
+	// average of samples collected since the previous update
+	temp := float64(avg(h.Seconds[max(0, len(h.Seconds)-p.cfg.Period):])) / 1000
+	dt := float64(p.cfg.Period)
+	lo, hi := float64(p.cfg.MinDuty), float64(p.cfg.MaxDuty)
+
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	s := &p.state
+	e := temp - float64(p.cfg.Setpoint)
+	pTerm := p.cfg.Kp * e
+
+	dTerm := 0.0
+	if p.primed {
+		raw := p.cfg.Kd * (temp - p.prev) / dt
+		dTerm = p.cfg.DFilter*float64(s.D) + (1-p.cfg.DFilter)*raw
+	}
+	p.prev, p.primed = temp, true
+
+	// don't integrate further into saturation
+	iTerm := float64(s.I)
+	out := pTerm + iTerm + dTerm
+	if !(out >= hi && e > 0) && !(out <= lo && e < 0) {
+		iTerm += p.cfg.Ki * e * dt
+	}
+	iTerm = math.Max(lo, math.Min(iTerm, hi))
+	out = math.Max(lo, math.Min(pTerm+iTerm+dTerm, hi))
+
+	*s = PIDState{
+		Setpoint: ShortFloat(p.cfg.Setpoint),
+		Temp:     ShortFloat(temp),
+		Error:    ShortFloat(e),
+		P:        ShortFloat(pTerm),
+		I:        ShortFloat(iTerm),
+		D:        ShortFloat(dTerm),
+		Output:   ShortFloat(out),
+	}
+
+	return FanDecision{
+		Duty: int(math.Round(out)),
+		Rule: "pid",
+		Inputs: map[string]int{
+			"temp":     int(temp * 1000),
+			"setpoint": p.cfg.Setpoint * 1000,
+		},
+	}
+}
+
+func (p *PIDPolicy) Report() interface{} {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return p.state
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/parMaster/rpid/config"
+)
+
+// TempHistory is the input of the fan control policy, temperatures in m˚C, latest last
+type TempHistory struct {
+	Seconds []int // momentary temperature, sampled every second
+	Minutes []int // temperature averaged by minute
+	Load    []int // CPU utilisation %, sampled every second, if feed-forward is configured
+}
+
+// FanDecision is what the policy wants to do with the fan
+type FanDecision struct {
+	Duty   int            // target duty, %
+	Keep   bool           // keep the fan as it is, Duty is ignored
+	Rule   string         // condition that triggered the decision
+	Inputs map[string]int // values the decision is based on
+	// duty % added by feed-forward, included in Duty
+	FeedForward int `json:",omitempty"`
+}
+
+// FanPolicy decides what to do with the fan, based on temperature history
+type FanPolicy interface {
+	Name() string
+	// Period is how often Decide should be called
+	Period() time.Duration
+	Decide(h TempHistory) FanDecision
+}
+
+// PolicyReporter is implemented by policies with internal state worth reporting
+type PolicyReporter interface {
+	Report() interface{}
+}
+
+// NewFanPolicy returns the fan control policy chosen by name in config,
+// with feed-forward if it is configured
+func NewFanPolicy(cfg config.Fan) (FanPolicy, error) {
+	p, err := newPolicy(cfg)
+	if err != nil || cfg.FeedForward.Gain == 0 {
+		return p, err
+	}
+	return newFeedForwardPolicy(p, cfg.FeedForward), nil
+}
+
+func newPolicy(cfg config.Fan) (FanPolicy, error) {
+	switch cfg.Policy {
+	case "", "hysteresis":
+		return NewHysteresisPolicy(cfg), nil
+	case "pid":
+		pid := cfg.PID
+		if pid.Setpoint == 0 {
+			pid.Setpoint = cfg.High
+		}
+		return NewPIDPolicy(pid), nil
+	case "curve":
+		return NewCurvePolicy(cfg.Curve)
+	default:
+		return nil, fmt.Errorf("fan policy %s is not supported", cfg.Policy)
+	}
+}
+
+// HysteresisPolicy turns the fan fully on above High and off below Low,
+// using 10s/30s/1m/3m moving averages to react on spikes and declines faster
+type HysteresisPolicy struct {
+	high, low int // m˚C
+	cfg       config.Hysteresis
+}
+
+func NewHysteresisPolicy(cfg config.Fan) *HysteresisPolicy {
+	return &HysteresisPolicy{
+		high: cfg.High * 1000, // fan   activation temperature m˚C
+		low:  cfg.Low * 1000,  // fan DEactivation temperature m˚C
+		cfg:  cfg.Hysteresis.WithDefaults(),
+	}
+}
+
+func (p *HysteresisPolicy) Name() string {
+	return "hysteresis"
+}
+
+func (p *HysteresisPolicy) Period() time.Duration {
+	return 10 * time.Second
+}
+
+func (p *HysteresisPolicy) Decide(h TempHistory) FanDecision {
+	ma10sec, ma30sec, ma1min, ma3min := 0, 0, last(h.Minutes), 0
+	if len(h.Seconds) >= 10 {
+		ma10sec = avg(h.Seconds[max(0, len(h.Seconds)-9) : len(h.Seconds)-1])
+	}
+	if len(h.Seconds) >= 30 {
+		ma30sec = avg(h.Seconds[max(0, len(h.Seconds)-29) : len(h.Seconds)-1])
+	}
+	if len(h.Minutes) >= 3 {
+		ma3min = avg(h.Minutes[max(0, len(h.Minutes)-2) : len(h.Minutes)-1])
+	}
+
+	d := FanDecision{
+		Keep:   true,
+		Inputs: map[string]int{"ma10sec": ma10sec, "ma30sec": ma30sec, "ma1min": ma1min, "ma3min": ma3min},
+	}
+
+	// Fan activation conditions
+	switch {
+	case ma10sec > p.high+p.cfg.Spike*1000:
+		d.Rule = "sudden spike"
+	case ma30sec > p.high+p.cfg.Rise*1000:
+		d.Rule = "fast rise"
+	case ma1min > p.high:
+		d.Rule = "high temperature"
+	case ma1min == 0, ma3min == 0:
+		d.Rule = "no data"
+	}
+	if d.Rule != "" {
+		d.Keep, d.Duty = false, 100
+		return d
+	}
+
+	// Deactivate otherwise
+	switch {
+	case ma3min < p.low:
+		d.Rule = "lower than low for 3 minutes"
+	case ma1min < p.low-p.cfg.Settle*1000:
+		d.Rule = "low enough"
+	case ma30sec < p.low-p.cfg.Decline*1000:
+		d.Rule = "fast decline"
+	case ma10sec < p.low-p.cfg.Drop*1000:
+		d.Rule = "sudden drop"
+	}
+	if d.Rule != "" {
+		d.Keep, d.Duty = false, 0
+	}
+	return d
+}
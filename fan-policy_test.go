@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/parMaster/rpid/config"
+	"github.com/stretchr/testify/assert"
+	"periph.io/x/conn/v3/gpio"
+)
+
+// repeat returns n copies of v
+func repeat(v, n int) []int {
+	out := make([]int, n)
+	for i := range out {
+		out[i] = v
+	}
+	return out
+}
+
+func Test_HysteresisPolicy(t *testing.T) {
+	p, err := NewFanPolicy(config.Fan{High: 48, Low: 40})
+	assert.NoError(t, err)
+	assert.Equal(t, "hysteresis", p.Name())
+
+	tests := []struct {
+		name string
+		h    TempHistory
+		duty int
+		keep bool
+		rule string
+	}{
+		{"no data", TempHistory{}, 100, false, "no data"},
+		{"spike", TempHistory{Seconds: repeat(59000, 30), Minutes: repeat(45000, 3)}, 100, false, "sudden spike"},
+		{"high", TempHistory{Seconds: repeat(45000, 30), Minutes: repeat(49000, 3)}, 100, false, "high temperature"},
+		{"between", TempHistory{Seconds: repeat(45000, 30), Minutes: repeat(45000, 3)}, 0, true, ""},
+		{"low", TempHistory{Seconds: repeat(39500, 30), Minutes: repeat(39500, 3)}, 0, false, "lower than low for 3 minutes"},
+		{"sudden drop", TempHistory{Seconds: repeat(35000, 30), Minutes: repeat(41000, 3)}, 0, false, "fast decline"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := p.Decide(tt.h)
+			assert.Equal(t, tt.keep, d.Keep)
+			assert.Equal(t, tt.rule, d.Rule)
+			if !tt.keep {
+				assert.Equal(t, tt.duty, d.Duty)
+			}
+		})
+	}
+
+	// partial offsets keep defaults for the rest
+	p, err = NewFanPolicy(config.Fan{High: 48, Low: 40, Hysteresis: config.Hysteresis{Spike: 15}})
+	assert.NoError(t, err)
+	d := p.Decide(TempHistory{Seconds: repeat(50000, 30), Minutes: repeat(45000, 3)})
+	assert.True(t, d.Keep, d.Rule)
+	d = p.Decide(TempHistory{Seconds: repeat(54000, 30), Minutes: repeat(45000, 3)})
+	assert.Equal(t, "fast rise", d.Rule)
+
+	_, err = NewFanPolicy(config.Fan{Policy: "magic"})
+	assert.Error(t, err)
+}
+
+func Test_PIDPolicy(t *testing.T) {
+	p, err := NewFanPolicy(config.Fan{High: 50, Policy: "pid", PID: config.PID{Kp: 10, Ki: 1, Kd: 5, DFilter: 0.5, Period: 5}})
+	assert.NoError(t, err)
+	pid := p.(*PIDPolicy)
+	assert.Equal(t, "pid", p.Name())
+
+	assert.Equal(t, 100, p.Decide(TempHistory{}).Duty)
+
+	// 2˚C above setpoint: P=20, I grows by 10 every update
+	d := p.Decide(TempHistory{Seconds: repeat(52000, 10)})
+	assert.Equal(t, 30, d.Duty)
+	d = p.Decide(TempHistory{Seconds: repeat(52000, 10)})
+	assert.Equal(t, 40, d.Duty)
+
+	// long overheat saturates the output, integral doesn't wind up beyond the range
+	for i := 0; i < 100; i++ {
+		d = p.Decide(TempHistory{Seconds: repeat(60000, 10)})
+	}
+	assert.Equal(t, 100, d.Duty)
+	assert.LessOrEqual(t, float64(pid.Report().(PIDState).I), 100.0)
+
+	// so it recovers as soon as temperature gets below setpoint
+	for i := 0; i < 3; i++ {
+		d = p.Decide(TempHistory{Seconds: repeat(45000, 10)})
+	}
+	assert.Less(t, d.Duty, 100)
+	for i := 0; i < 30; i++ {
+		d = p.Decide(TempHistory{Seconds: repeat(45000, 10)})
+	}
+	assert.Equal(t, 0, d.Duty)
+
+	s := pid.Report().(PIDState)
+	assert.Equal(t, ShortFloat(50), s.Setpoint)
+	assert.Equal(t, ShortFloat(-5), s.Error)
+}
+
+func Test_CurvePolicy(t *testing.T) {
+	cfg := config.Fan{Policy: "curve", Curve: config.Curve{
+		Points: []config.CurvePoint{{Temp: 60, Duty: 100}, {Temp: 40, Duty: 20}, {Temp: 50, Duty: 40}},
+		Rise:   1,
+		Fall:   3,
+		Input:  "10s",
+	}}
+	p, err := NewFanPolicy(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "curve", p.Name())
+
+	tests := []struct {
+		temp int
+		duty int
+		keep bool
+		rule string
+	}{
+		{45000, 30, false, "start"},
+		{45500, 0, true, ""},         // within rise hysteresis
+		{46000, 32, false, "rising"}, // interpolated between 40˚C and 50˚C
+		{44000, 0, true, ""},         // within fall hysteresis
+		{43000, 26, false, "falling"},
+		{30000, 20, false, "falling"}, // below the first point
+		{70000, 100, false, "rising"}, // above the last point
+	}
+	for _, tt := range tests {
+		d := p.Decide(TempHistory{Seconds: repeat(tt.temp, 10)})
+		assert.Equal(t, tt.keep, d.Keep, tt.temp)
+		assert.Equal(t, tt.rule, d.Rule, tt.temp)
+		if !tt.keep {
+			assert.Equal(t, tt.duty, d.Duty, tt.temp)
+		}
+	}
+
+	s := p.(*CurvePolicy).Report().(CurveState)
+	assert.Equal(t, 100, s.Duty)
+	assert.Equal(t, 40.0, s.Points[0].Temp)
+
+	assert.Equal(t, "no data", p.Decide(TempHistory{}).Rule)
+
+	_, err = NewFanPolicy(config.Fan{Policy: "curve"})
+	assert.Error(t, err)
+	cfg.Curve.Input = "5m"
+	_, err = NewFanPolicy(cfg)
+	assert.Error(t, err)
+}
+
+func Test_FeedForward(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stat")
+	write := func(user, idle int) {
+		line := fmt.Sprintf("cpu  %d 0 0 %d 0 0 0 0 0 0\ncpu0 1 2 3 4 5 6 7 8 9 10\n", user, idle)
+		assert.NoError(t, os.WriteFile(path, []byte(line), 0o600))
+	}
+	s := &cpuStat{path: path}
+	write(100, 100)
+	u, err := s.Utilisation()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, u) // first read has nothing to compare with
+	write(175, 125)
+	u, err = s.Utilisation()
+	assert.NoError(t, err)
+	assert.Equal(t, 75, u)
+
+	cfg := config.Fan{High: 48, Low: 40, Policy: "pid", PID: config.PID{Kp: 10},
+		FeedForward: config.FeedForward{Gain: 0.5, Threshold: 20}}
+	p, err := NewFanPolicy(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "pid", p.Name())
+
+	// 1˚C above setpoint, 80% load
+	d := p.Decide(TempHistory{Seconds: repeat(49000, 10), Load: repeat(80, 10)})
+	assert.Equal(t, 30, d.FeedForward)
+	assert.Equal(t, 40, d.Duty)
+	assert.Equal(t, 80, d.Inputs["load"])
+
+	// load goes away, so does its contribution
+	d = p.Decide(TempHistory{Seconds: repeat(49000, 10), Load: repeat(10, 10)})
+	assert.Equal(t, 0, d.FeedForward)
+	assert.Equal(t, 10, d.Duty)
+
+	// hysteresis keeps the fan off, feed-forward pre-spins it
+	cfg.Policy = ""
+	p, err = NewFanPolicy(cfg)
+	assert.NoError(t, err)
+	d = p.Decide(TempHistory{Seconds: repeat(44000, 60), Minutes: repeat(44000, 3), Load: repeat(100, 10)})
+	assert.False(t, d.Keep)
+	assert.Equal(t, 40, d.Duty)
+	assert.Equal(t, "feed-forward", d.Rule)
+
+	// contribution is shown in the decision event
+	cfg.Policy = "pid"
+	p, err = NewFanPolicy(cfg)
+	assert.NoError(t, err)
+	fan := newPWMFan(&testPin{PinIO: gpio.INVALID}, config.PWM{})
+	c := &FanController{cfg: cfg, fan: fan, policy: p, data: testHistory()}
+	c.data["load"] = secondly[int](config.History{})
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		c.data["t"].Add(now, 49000)
+		c.data["load"].Add(now, 80)
+	}
+	c.step(context.Background(), now)
+	events := c.Events()
+	assert.Len(t, events, 1)
+	assert.Equal(t, "decision", events[0].Kind)
+	assert.Equal(t, 30, events[0].FeedForward)
+	assert.Equal(t, 40, events[0].Duty)
+
+	// clamped and capped contribution is recorded as applied
+	for i := 0; i < 10; i++ {
+		c.data["t"].Add(now, 60000)
+		c.data["load"].Add(now, 100)
+	}
+	d = p.Decide(c.history(now))
+	assert.Equal(t, 100, d.Duty)
+	assert.Equal(t, 0, d.FeedForward, "PID alone is at full speed")
+	d = capDecision(FanDecision{Duty: 70, FeedForward: 30}, 50)
+	assert.Equal(t, 50, d.Duty)
+	assert.Equal(t, 10, d.FeedForward)
+	d = capDecision(FanDecision{Duty: 70, FeedForward: 10}, 50)
+	assert.Equal(t, 0, d.FeedForward)
+}
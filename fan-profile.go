@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/parMaster/rpid/config"
+)
+
+// default critical temperature ˚C, Raspberry Pi firmware starts throttling at 80˚C
+const defaultCritical = 80
+
+// fanProfile is the time window with its own fan policy
+type fanProfile struct {
+	cfg      config.Profile
+	days     map[time.Weekday]bool
+	from, to int // minutes since midnight
+	policy   FanPolicy
+}
+
+func newFanProfile(fan config.Fan, cfg config.Profile) (*fanProfile, error) {
+	p := &fanProfile{cfg: cfg}
+	var err error
+	if p.days, err = cfg.Weekdays(); err != nil {
+		return nil, err
+	}
+	if p.from, p.to, err = cfg.Window(); err != nil {
+		return nil, err
+	}
+	if p.policy, err = NewFanPolicy(fan.WithTuning(cfg.Tuning)); err != nil {
+		return nil, fmt.Errorf("profile %s: %w", cfg.Name, err)
+	}
+	return p, nil
+}
+
+// Active reports if the time is within the profile window.
+// Overnight window belongs to the day it starts on
+func (p *fanProfile) Active(now time.Time) bool {
+	m := now.Hour()*60 + now.Minute()
+	if p.from <= p.to {
+		return p.days[now.Weekday()] && m >= p.from && m < p.to
+	}
+	if m >= p.from {
+		return p.days[now.Weekday()]
+	}
+	return m < p.to && p.days[now.AddDate(0, 0, -1).Weekday()]
+}
+
+// switchProfile activates the profile matching the time, returns the policy to follow
+func (c *FanController) switchProfile(ctx context.Context, now time.Time) FanPolicy {
+	var active *fanProfile
+	for _, p := range c.profiles {
+		if p.Active(now) {
+			active = p
+			break
+		}
+	}
+
+	c.mx.Lock()
+	changed := active != c.profile
+	c.profile = active
+	c.mx.Unlock()
+
+	if changed {
+		c.event(ctx, FanEvent{Time: now, Kind: "profile", Rule: c.ProfileName(), Duty: c.Duty()})
+	}
+	if active == nil {
+		return c.policy
+	}
+	return active.policy
+}
+
+// ProfileName returns the active profile name, "default" if none is active
+func (c *FanController) ProfileName() string {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.profile == nil {
+		return "default"
+	}
+	return c.profile.cfg.Name
+}
+
+// activePolicy returns the policy of the active profile, or the fan policy
+func (c *FanController) activePolicy() FanPolicy {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.profile == nil {
+		return c.policy
+	}
+	return c.profile.policy
+}
+
+// critical returns the input temperature and reports if it reached the critical one
+func (c *FanController) critical() (int, bool) {
+	c.mx.Lock()
+	temp := c.data["t"].LastValue()
+	c.mx.Unlock()
+	return temp, temp >= c.criticalTemp()
+}
+
+// criticalTemp is the temperature fan runs at full speed above, m˚C
+func (c *FanController) criticalTemp() int {
+	if c.cfg.Critical <= 0 {
+		return defaultCritical * 1000
+	}
+	return c.cfg.Critical * 1000
+}
+
+// capDuty applies the duty cap of the active profile
+func (c *FanController) capDuty(d FanDecision) FanDecision {
+	c.mx.Lock()
+	profile := c.profile
+	c.mx.Unlock()
+	if profile == nil || profile.cfg.MaxDuty == 0 {
+		return d
+	}
+	if d.Keep {
+		// fan could be left running faster by the previous profile
+		if c.Duty() <= profile.cfg.MaxDuty {
+			return d
+		}
+		d.Keep, d.Duty = false, c.Duty()
+	}
+	if d.Duty > profile.cfg.MaxDuty {
+		d = capDecision(d, profile.cfg.MaxDuty)
+		d.Rule += ", capped by " + profile.cfg.Name
+	}
+	return d
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/parMaster/rpid/config"
+	"github.com/parMaster/rpid/storage/model"
+)
+
+// duties PWM fans are swept through, %
+var selfTestSweep = []int{20, 40, 60, 80, 100}
+
+// SelfTestResult is the outcome of the fan self-test
+type SelfTestResult struct {
+	Fan      string
+	Running  bool
+	Started  time.Time
+	Finished time.Time `json:",omitempty"`
+	Passed   bool
+	Error    string      `json:",omitempty"`
+	SpinUp   ShortFloat  // s until tachymeter pulses appeared
+	OnRPM    int         // at full speed
+	OffRPM   int         // after spin down time with the fan off
+	Curve    map[int]int `json:",omitempty"` // duty % → rpm, PWM and cooling device fans only
+}
+
+// selfTestTiming is how long the self-test waits for the fan
+type selfTestTiming struct {
+	timeout  time.Duration // for pulses to appear
+	spinDown time.Duration // for rpm to decay
+	settle   time.Duration // at full speed and at each sweep step
+	poll     time.Duration // rpm check interval
+}
+
+func newSelfTestTiming(cfg config.SelfTest) selfTestTiming {
+	t := selfTestTiming{
+		timeout:  time.Duration(cfg.Timeout) * time.Second,
+		spinDown: time.Duration(cfg.SpinDown) * time.Second,
+		settle:   time.Duration(cfg.Settle) * time.Second,
+		poll:     200 * time.Millisecond,
+	}
+	if t.timeout <= 0 {
+		t.timeout = 5 * time.Second
+	}
+	if t.spinDown <= 0 {
+		t.spinDown = 10 * time.Second
+	}
+	if t.settle <= 0 {
+		t.settle = 5 * time.Second
+	}
+	return t
+}
+
+// SelfTest drives the fan on and checks tachymeter pulses appear, then off and checks rpm decays,
+// then sweeps PWM duty recording rpm. Fan failing the test is kept at full speed (safe mode)
+// until it passes the test again. Fan mode is restored afterwards
+func (c *FanController) SelfTest(ctx context.Context) (SelfTestResult, error) {
+	return c.selfTest(ctx, newSelfTestTiming(c.cfg.SelfTest))
+}
+
+func (c *FanController) selfTest(ctx context.Context, tm selfTestTiming) (res SelfTestResult, err error) {
+	if c.fan == nil || c.tach == nil {
+		return res, fmt.Errorf("self-test of %s needs fan control and tachymeter", c.Name())
+	}
+
+	if err = c.acquire("self-test"); err != nil {
+		return res, err
+	}
+	defer c.release()
+
+	c.mx.Lock()
+	res = SelfTestResult{Fan: c.Name(), Running: true, Started: time.Now()}
+	started := res
+	c.selftest = &started
+	c.mx.Unlock()
+
+	prev := c.Override()
+	defer func() {
+		c.restoreOverride(ctx, prev)
+		c.finishSelfTest(ctx, &res, err)
+	}()
+
+	log.Printf("[INFO] Self-test of %s started", c.Name())
+	minRPM := c.cfg.Stall.MinRPM
+	if minRPM <= 0 {
+		minRPM = 100
+	}
+
+	if _, err = c.setOverride(ctx, FanOn, 0, 0); err != nil {
+		return res, err
+	}
+	at, err := c.waitRPM(ctx, res.Started, tm, func(rpm int) bool { return rpm >= minRPM })
+	if err != nil {
+		return res, err
+	}
+	if at.IsZero() {
+		return res, fmt.Errorf("no tachymeter pulses within %s at full speed", tm.timeout)
+	}
+	res.SpinUp = ShortFloat(at.Sub(res.Started).Seconds())
+	if res.OnRPM, err = c.settledRPM(ctx, tm.settle); err != nil {
+		return res, err
+	}
+
+	if _, err = c.setOverride(ctx, FanOff, 0, 0); err != nil {
+		return res, err
+	}
+	if res.OffRPM, err = c.settledRPM(ctx, tm.spinDown); err != nil {
+		return res, err
+	}
+	if res.OffRPM > res.OnRPM/2 {
+		return res, fmt.Errorf("rpm doesn't decay with the fan off: %d rpm on, %d rpm off", res.OnRPM, res.OffRPM)
+	}
+
+	if c.cfg.Mode == "pwm" || c.cfg.Mode == "cooling" {
+		res.Curve = map[int]int{}
+		for _, duty := range selfTestSweep {
+			if _, err = c.setOverride(ctx, FanDuty, duty, 0); err != nil {
+				return res, err
+			}
+			if res.Curve[duty], err = c.settledRPM(ctx, tm.settle); err != nil {
+				return res, err
+			}
+		}
+	}
+	return res, nil
+}
+
+// waitRPM polls measured rpm until it satisfies ok, returns the sample time or zero time on timeout
+func (c *FanController) waitRPM(ctx context.Context, since time.Time, tm selfTestTiming, ok func(rpm int) bool) (time.Time, error) {
+	ticker := time.NewTicker(tm.poll)
+	defer ticker.Stop()
+	for deadline := time.Now().Add(tm.timeout); time.Now().Before(deadline); {
+		select {
+		case <-ctx.Done():
+			return time.Time{}, ctx.Err()
+		case <-ticker.C:
+		}
+		c.mx.Lock()
+		points := c.data["revs"].Points()
+		c.mx.Unlock()
+		for _, p := range points {
+			if p.Time.After(since) && ok(p.Value) {
+				return p.Time, nil
+			}
+		}
+	}
+	return time.Time{}, nil
+}
+
+// settledRPM waits for d and returns the average rpm over its second half
+func (c *FanController) settledRPM(ctx context.Context, d time.Duration) (int, error) {
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-time.After(d):
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return avg(c.data["revs"].Window(d / 2)), nil
+}
+
+// finishSelfTest records the result and switches safe mode on or off
+func (c *FanController) finishSelfTest(ctx context.Context, res *SelfTestResult, err error) {
+	res.Running, res.Finished, res.Passed = false, time.Now(), err == nil
+	if err != nil {
+		res.Error = err.Error()
+	}
+	done := *res
+	failed := err != nil && ctx.Err() == nil // interrupted test says nothing about the fan
+	c.mx.Lock()
+	c.selftest = &done
+	if res.Passed || failed {
+		c.safe = failed
+	}
+	c.mx.Unlock()
+
+	if failed {
+		log.Printf("[WARN] Self-test of %s failed, fan is kept at full speed: %v", c.Name(), err)
+		if err := c.setDuty(100); err != nil {
+			log.Printf("[ERROR] Can't force %s on: %v", c.Name(), err)
+		}
+		c.event(ctx, FanEvent{Kind: "fault", Rule: "self-test failed, safe mode", Duty: c.Duty()})
+	} else if res.Passed {
+		log.Printf("[INFO] Self-test of %s passed: %+v", c.Name(), done)
+	}
+
+	if c.store == nil {
+		return
+	}
+	value, merr := json.Marshal(done)
+	if merr != nil {
+		log.Printf("[ERROR] Failed to marshal %s self-test: %v", c.Name(), merr)
+		return
+	}
+	if werr := c.store.Write(ctx, model.Data{Module: "fan", Topic: c.topic("selftest"), Text: string(value)}); werr != nil {
+		log.Printf("[ERROR] Failed to store %s self-test: %v", c.Name(), werr)
+	}
+}
+
+// safeMode reports if the fan failed the self-test and isn't being tested again
+func (c *FanController) safeMode() bool {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.safe && (c.selftest == nil || !c.selftest.Running)
+}
+
+// SelfTestResult returns the latest self-test result, nil if it never ran
+func (c *FanController) SelfTestResult() *SelfTestResult {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.selftest == nil {
+		return nil
+	}
+	res := *c.selftest
+	return &res
+}
+
+// startSelfTest handles POST /fan/selftest with {"fan": "name"}, self-test runs in background
+func (w *Worker) startSelfTest(rw http.ResponseWriter, r *http.Request) {
+	var req fanRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f := w.fanByName(req.Fan)
+	if f == nil {
+		http.Error(rw, fmt.Sprintf("fan %q not found", req.Fan), http.StatusNotFound)
+		return
+	}
+	if job := f.Busy(); job != "" {
+		http.Error(rw, fmt.Sprintf("%s of %s is running", job, f.Name()), http.StatusConflict)
+		return
+	}
+
+	go func() {
+		if _, err := f.SelfTest(w.ctx); err != nil {
+			log.Printf("[ERROR] Self-test of %s: %v", f.Name(), err)
+		}
+	}()
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+// selfTestResults handles GET /fan/selftest, returns the latest self-test of every fan
+func (w *Worker) selfTestResults(rw http.ResponseWriter, r *http.Request) {
+	out := map[string]*SelfTestResult{}
+	for _, f := range w.fans {
+		out[f.Name()] = f.SelfTestResult()
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(out)
+}
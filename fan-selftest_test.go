@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/parMaster/rpid/config"
+	"github.com/stretchr/testify/assert"
+	"periph.io/x/conn/v3/gpio"
+)
+
+func Test_SelfTest(t *testing.T) {
+	newFan := func(mode string) *FanController {
+		cfg := config.Fan{Name: "exhaust", High: 48, Low: 40, Mode: mode}
+		policy, err := NewFanPolicy(cfg)
+		assert.NoError(t, err)
+		actuator, err := NewFanActuator(&testPin{PinIO: gpio.INVALID}, cfg)
+		assert.NoError(t, err)
+		data := testHistory()
+		data["revs"] = secondly[int](config.History{})
+		return &FanController{
+			cfg:    cfg,
+			input:  func() (int, error) { return 50000, nil },
+			fan:    actuator,
+			tach:   NewTach(2, 0),
+			policy: policy,
+			data:   data,
+		}
+	}
+	tm := selfTestTiming{timeout: 200 * time.Millisecond, spinDown: 100 * time.Millisecond, settle: 100 * time.Millisecond, poll: 5 * time.Millisecond}
+
+	// rpm follows duty, unless the fan is stuck
+	var stuck atomic.Bool
+	spin := func(ctx context.Context, c *FanController) {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			rpm := 30 * c.Duty()
+			if stuck.Load() {
+				rpm = 0
+			}
+			c.mx.Lock()
+			c.data["revs"].Add(time.Now(), rpm)
+			c.mx.Unlock()
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := newFan("pwm")
+	go spin(ctx, c)
+	_, err := c.SetOverride(ctx, FanDuty, 30, 0)
+	assert.NoError(t, err)
+
+	res, err := c.selfTest(ctx, tm)
+	assert.NoError(t, err)
+	assert.True(t, res.Passed)
+	assert.Equal(t, 3000, res.OnRPM)
+	assert.Equal(t, 0, res.OffRPM)
+	assert.Equal(t, map[int]int{20: 600, 40: 1200, 60: 1800, 80: 2400, 100: 3000}, res.Curve)
+	assert.Equal(t, FanDuty, c.Override().Mode, "mode is restored")
+	assert.Equal(t, "passed", c.Status()["selftest"])
+	assert.False(t, c.safeMode())
+
+	// stuck fan fails and is kept at full speed
+	stuck.Store(true)
+	_, err = c.selfTest(ctx, tm)
+	assert.ErrorContains(t, err, "no tachymeter pulses")
+	assert.False(t, c.SelfTestResult().Passed)
+	assert.True(t, c.safeMode())
+	assert.Equal(t, "safe", c.Status()["mode"])
+	assert.Equal(t, 100, c.Duty())
+	fault := c.events[len(c.events)-1]
+	assert.Equal(t, "fault", fault.Kind)
+	assert.Equal(t, 100, fault.Duty, "full speed is set through the controller")
+	d := c.step(ctx, time.Now())
+	assert.Equal(t, "safe mode", d.Rule)
+	assert.Equal(t, 100, c.Duty())
+
+	// passing the test again leaves safe mode
+	stuck.Store(false)
+	_, err = c.selfTest(ctx, tm)
+	assert.NoError(t, err)
+	assert.False(t, c.safeMode())
+
+	// onoff fan isn't swept
+	c = newFan("onoff")
+	go spin(ctx, c)
+	res, err = c.selfTest(ctx, tm)
+	assert.NoError(t, err)
+	assert.Nil(t, res.Curve)
+
+	// self-test doesn't start while autotune runs
+	assert.NoError(t, c.acquire("autotune"))
+	_, err = c.selfTest(ctx, tm)
+	assert.ErrorIs(t, err, ErrFanBusy)
+	w := &Worker{fans: []*FanController{c}}
+	rec := httptest.NewRecorder()
+	w.startSelfTest(rec, httptest.NewRequest("POST", "/fan/selftest", strings.NewReader(`{}`)))
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	c.release()
+
+	// no tachymeter, nothing to test
+	c.tach = nil
+	_, err = c.selfTest(ctx, tm)
+	assert.Error(t, err)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/parMaster/rpid/config"
+	"github.com/parMaster/rpid/storage/model"
+)
+
+// shadowPolicy is the candidate policy deciding on live data without driving the fan
+type shadowPolicy struct {
+	cfg       config.Shadow
+	policy    FanPolicy
+	next      time.Time // when the policy decides next, at its own period
+	primed    bool      // duty is set
+	duty      int       // % the fan would run at
+	decisions int       // decisions compared with the active policy
+	agreed    int       // decisions with the same duty as the actual one
+	switches  int       // hypothetical duty changes
+	dutySum   int       // sum of hypothetical duty over decisions
+	actualSum int       // sum of actual duty over decisions
+}
+
+func newShadowPolicy(fan config.Fan, cfg config.Shadow) (*shadowPolicy, error) {
+	policy, err := NewFanPolicy(fan.WithTuning(cfg.Tuning))
+	if err != nil {
+		return nil, fmt.Errorf("shadow %s: %w", cfg.Name, err)
+	}
+	return &shadowPolicy{cfg: cfg, policy: policy}, nil
+}
+
+// decide runs the candidate policy, returns the decision if the hypothetical duty changed
+func (s *shadowPolicy) decide(h TempHistory, actual int) (FanDecision, bool) {
+	d := s.policy.Decide(h)
+	if !s.primed {
+		s.primed, s.duty = true, actual
+	}
+	changed := false
+	if !d.Keep {
+		if s.cfg.MaxDuty > 0 {
+			d = capDecision(d, s.cfg.MaxDuty)
+		}
+		changed = d.Duty != s.duty
+		if changed {
+			s.switches++
+		}
+		s.duty = d.Duty
+	}
+
+	s.decisions++
+	if s.duty == actual {
+		s.agreed++
+	}
+	s.dutySum += s.duty
+	s.actualSum += actual
+	return d, changed
+}
+
+// ShadowSummary compares the shadow policy with the active one since start
+type ShadowSummary struct {
+	Name           string
+	Policy         string
+	Decisions      int
+	Agreement      ShortFloat // share of decisions with the same duty as the actual one
+	Switches       int        // fan duty changes the shadow policy would have made
+	ActualSwitches int        // fan duty changes actually made by policy
+	EstimatedDuty  ShortFloat // %, average duty the shadow policy would have run the fan at
+	ActualDuty     ShortFloat // %, average actual duty
+}
+
+func (s *shadowPolicy) summary(actualSwitches int) ShadowSummary {
+	out := ShadowSummary{Name: s.cfg.Name, Policy: s.policy.Name(), Decisions: s.decisions,
+		Switches: s.switches, ActualSwitches: actualSwitches}
+	if s.decisions > 0 {
+		out.Agreement = ShortFloat(float64(s.agreed) / float64(s.decisions))
+		out.EstimatedDuty = ShortFloat(float64(s.dutySum) / float64(s.decisions))
+		out.ActualDuty = ShortFloat(float64(s.actualSum) / float64(s.decisions))
+	}
+	return out
+}
+
+// shadowStep runs shadow policies due by their own period, storing their decisions next to the real ones.
+// Called every second
+func (c *FanController) shadowStep(ctx context.Context, now time.Time) {
+	c.mx.Lock()
+	due := false
+	for _, s := range c.shadows {
+		due = due || !now.Before(s.next)
+	}
+	c.mx.Unlock()
+	if !due {
+		return
+	}
+	h := c.history(now)
+	actual := c.Duty()
+
+	c.mx.Lock()
+	var changed []FanEvent
+	for _, s := range c.shadows {
+		if now.Before(s.next) {
+			continue
+		}
+		s.next = now.Add(s.policy.Period())
+		if d, ok := s.decide(h, actual); ok {
+			changed = append(changed, FanEvent{Time: now, Fan: c.Name(), Kind: "shadow",
+				Rule: s.cfg.Name + ": " + d.Rule, Duty: d.Duty, Inputs: d.Inputs, FeedForward: d.FeedForward})
+		}
+	}
+	c.mx.Unlock()
+
+	for _, e := range changed {
+		log.Printf("[DEBUG] %s %s", e.Fan, e.Rule)
+		if c.store == nil {
+			continue
+		}
+		value, err := json.Marshal(e)
+		if err != nil {
+			log.Printf("[ERROR] Failed to marshal %s shadow decision: %v", e.Fan, err)
+			continue
+		}
+		d := model.Data{Module: "fan", Time: now, Topic: c.topic("shadow"), Text: string(value)}
+		if err := c.store.Write(ctx, d); err != nil {
+			log.Printf("[ERROR] Failed to store %s shadow decision: %v", e.Fan, err)
+		}
+	}
+}
+
+// ShadowSummary returns the comparison of every shadow policy with the active one
+func (c *FanController) ShadowSummary() []ShadowSummary {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	out := []ShadowSummary{}
+	for _, s := range c.shadows {
+		out = append(out, s.summary(c.switches))
+	}
+	return out
+}
+
+// fanShadow handles GET /fan/shadow, returns shadow policies summary by fan
+func (w *Worker) fanShadow(rw http.ResponseWriter, r *http.Request) {
+	out := map[string][]ShadowSummary{}
+	for _, f := range w.fans {
+		out[f.Name()] = f.ShadowSummary()
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(rw).Encode(out)
+}
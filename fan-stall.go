@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/parMaster/rpid/config"
+)
+
+const (
+	FaultStall    = "stall"              // fan is driven on, but doesn't spin
+	FaultSpinning = "spinning while off" // fan is driven off, but spins
+	FaultRecovery = "recovered"          // fan follows the command again
+)
+
+// stallDetector compares commanded fan duty with measured rpm
+type stallDetector struct {
+	cfg     config.Stall
+	since   time.Time // when rpm started to disagree with the command
+	fault   string    // current fault, "" if fan is ok
+	retries int       // kick-starts since the fault was detected
+}
+
+func newStallDetector(cfg config.Stall) *stallDetector {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 30
+	}
+	if cfg.MinRPM <= 0 {
+		cfg.MinRPM = 100
+	}
+	if cfg.Retries <= 0 {
+		cfg.Retries = 3
+	}
+	return &stallDetector{cfg: cfg}
+}
+
+// Check returns a fault (or recovery) event, if any, and whether the fan should be kick-started
+func (s *stallDetector) Check(now time.Time, duty, rpm int) (event string, kick bool) {
+	mismatch := ""
+	switch {
+	case duty > 0 && rpm < s.cfg.MinRPM:
+		mismatch = FaultStall
+	case duty == 0 && rpm >= s.cfg.MinRPM:
+		mismatch = FaultSpinning
+	}
+
+	if mismatch == "" && duty == 0 && s.fault == FaultStall {
+		// stopped fan commanded off says nothing about the stall, it's still there
+		s.since = time.Time{}
+		return "", false
+	}
+
+	if mismatch == "" {
+		if s.fault != "" {
+			event = FaultRecovery
+		}
+		s.since, s.fault, s.retries = time.Time{}, "", 0
+		return event, false
+	}
+
+	if s.since.IsZero() {
+		s.since = now
+	}
+	if now.Sub(s.since) < time.Duration(s.cfg.Timeout)*time.Second {
+		return "", false
+	}
+
+	// restart the window, so the fault is re-reported and kick is retried every Timeout
+	s.since = now
+	s.fault = mismatch
+	if mismatch == FaultStall && s.retries < s.cfg.Retries {
+		s.retries++
+		kick = true
+	}
+	return mismatch, kick
+}
+
+// checkStall checks if the fan spins as commanded, called every second.
+// It isn't checked while the fan is kick-started
+func (c *FanController) checkStall(ctx context.Context, now time.Time, rpm int) {
+	if c.kicking(now) {
+		return
+	}
+
+	duty := c.Duty()
+	event, kick := c.stall.Check(now, duty, rpm)
+	if event == "" {
+		return
+	}
+
+	c.mx.Lock()
+	c.degraded = event != FaultRecovery
+	if c.degraded {
+		c.faults++
+		log.Printf("[WARN] %s fault: %s (duty %d%%, %d rpm), faults so far: %d", c.Name(), event, duty, rpm, c.faults)
+	}
+	c.mx.Unlock()
+
+	c.event(ctx, FanEvent{Time: now, Kind: "fault", Rule: event, Duty: duty, Inputs: map[string]int{"rpm": rpm}})
+
+	if kick {
+		c.kick(now)
+	}
+}
+
+// kick spins the stalled fan at full speed for a moment. Duty set by the control loop
+// meanwhile is kept aside and applied when the kick is over
+func (c *FanController) kick(now time.Time) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	log.Printf("[INFO] Kick-starting %s", c.Name())
+	duty := c.fan.Duty()
+	if err := c.fan.SetDuty(100); err != nil {
+		log.Printf("[ERROR] Kick-starting %s: %v", c.Name(), err)
+		return
+	}
+	c.kickDuty, c.kickUntil = duty, now.Add(kickStartTime)
+}
+
+// kicking reports if the fan is being kick-started, restores its duty once the kick is over
+func (c *FanController) kicking(now time.Time) bool {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.kickUntil.IsZero() {
+		return false
+	}
+	if now.Before(c.kickUntil) {
+		return true
+	}
+	c.kickUntil = time.Time{}
+	if err := c.fan.SetDuty(c.kickDuty); err != nil {
+		log.Printf("[ERROR] Restoring %s duty after kick-start: %v", c.Name(), err)
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/parMaster/rpid/config"
+	"github.com/stretchr/testify/assert"
+	"periph.io/x/conn/v3/gpio"
+)
+
+func Test_StallDetector(t *testing.T) {
+	s := newStallDetector(config.Stall{Timeout: 10, MinRPM: 100, Retries: 2})
+	start := time.Now()
+	at := func(sec int) time.Time { return start.Add(time.Duration(sec) * time.Second) }
+
+	// spinning as commanded
+	ev, kick := s.Check(at(0), 100, 2000)
+	assert.Equal(t, "", ev)
+	assert.False(t, kick)
+
+	// stalled, but not for long enough yet
+	ev, _ = s.Check(at(1), 100, 0)
+	assert.Equal(t, "", ev)
+	ev, kick = s.Check(at(11), 100, 0)
+	assert.Equal(t, FaultStall, ev)
+	assert.True(t, kick)
+
+	// retried every timeout, until retries are exhausted
+	ev, kick = s.Check(at(21), 100, 0)
+	assert.Equal(t, FaultStall, ev)
+	assert.True(t, kick)
+	ev, kick = s.Check(at(31), 100, 0)
+	assert.Equal(t, FaultStall, ev)
+	assert.False(t, kick)
+
+	// stopped fan commanded off is no recovery, retries aren't reset
+	ev, _ = s.Check(at(32), 0, 0)
+	assert.Equal(t, "", ev)
+	assert.Equal(t, FaultStall, s.fault)
+	ev, kick = s.Check(at(43), 100, 0)
+	assert.Equal(t, "", ev)
+	assert.False(t, kick)
+	ev, kick = s.Check(at(53), 100, 0)
+	assert.Equal(t, FaultStall, ev)
+	assert.False(t, kick)
+
+	ev, _ = s.Check(at(54), 100, 1500)
+	assert.Equal(t, FaultRecovery, ev)
+	assert.Zero(t, s.retries)
+
+	// spinning while commanded off
+	s.Check(at(60), 0, 1500)
+	ev, kick = s.Check(at(70), 0, 1500)
+	assert.Equal(t, FaultSpinning, ev)
+	assert.False(t, kick)
+}
+
+func Test_StallKick(t *testing.T) {
+	pin := &testPin{PinIO: gpio.INVALID}
+	fan := newPWMFan(pin, config.PWM{})
+	c := &FanController{
+		fan:   fan,
+		stall: newStallDetector(config.Stall{Timeout: 10, Retries: 1}),
+		data:  testHistory(),
+	}
+	ctx := context.Background()
+	start := time.Now()
+	at := func(sec int) time.Time { return start.Add(time.Duration(sec) * time.Second) }
+
+	assert.NoError(t, c.setDuty(40))
+	c.checkStall(ctx, at(0), 0)
+	c.checkStall(ctx, at(10), 0)
+	assert.Equal(t, 100, c.Duty(), "kick-start at full speed, never stopping the fan")
+	assert.NotContains(t, pin.duties, gpio.Duty(0))
+
+	// control loop decision waits for the kick to end, stall isn't checked meanwhile
+	assert.NoError(t, c.setDuty(30))
+	assert.Equal(t, 100, c.Duty())
+	c.checkStall(ctx, at(10).Add(kickStartTime/2), 0)
+	assert.Equal(t, 100, c.Duty())
+	c.checkStall(ctx, at(11), 0)
+	assert.Equal(t, 30, c.Duty())
+
+	// still stalled, retries are exhausted
+	c.checkStall(ctx, at(21), 0)
+	assert.Equal(t, 30, c.Duty())
+	assert.Equal(t, 2, c.faults)
+	assert.True(t, c.degraded)
+
+	// full speed decision made during the kick is kept after it
+	assert.NoError(t, c.setDuty(40))
+	c.kick(at(30))
+	c.apply(ctx, at(30), FanDecision{Duty: 100, Rule: "critical"})
+	assert.True(t, c.kicking(at(30)))
+	assert.False(t, c.kicking(at(32)))
+	assert.Equal(t, 100, c.Duty(), "decision isn't dropped as unchanged")
+}
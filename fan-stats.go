@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// FanStats is the fan lifetime statistics, persisted across restarts
+type FanStats struct {
+	Fan         string
+	Since       time.Time // first run, or the latest reset
+	RunSeconds  int64     // total running time
+	RunHours    float64
+	Revolutions int64
+	Starts      int     // stopped → running transitions
+	DutySeconds int64   // duty % × running seconds
+	AvgDuty     float64 // % while running
+	Maintenance bool    // running hours reached MaintenanceHours, alert is sent
+	revs        int     // rpm × seconds not counted in Revolutions yet
+	running     bool    // fan was running at the previous sample
+}
+
+// countStats adds one second of fan work to the lifetime statistics, c.mx is held
+func (c *FanController) countStats(now time.Time, rpm int) (alert bool) {
+	s := &c.stats
+	if s.Since.IsZero() {
+		s.Since = now
+	}
+	duty := c.Duty()
+	running := duty > 0
+	if c.fan == nil {
+		running = rpm > 0 // tachymeter only
+	}
+	if running && !s.running {
+		s.Starts++
+	}
+	s.running = running
+	if !running {
+		return false
+	}
+
+	s.RunSeconds++
+	s.DutySeconds += int64(duty)
+	s.revs += rpm
+	s.Revolutions += int64(s.revs / 60)
+	s.revs %= 60
+
+	hours := c.cfg.MaintenanceHours
+	if hours > 0 && !s.Maintenance && s.RunSeconds >= int64(hours)*3600 {
+		s.Maintenance = true
+		return true
+	}
+	return false
+}
+
+// Stats returns the fan lifetime statistics
+func (c *FanController) Stats() FanStats {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	s := c.stats
+	s.Fan = c.Name()
+	s.RunHours = float64(s.RunSeconds) / 3600
+	if s.RunSeconds > 0 {
+		s.AvgDuty = float64(s.DutySeconds) / float64(s.RunSeconds)
+	}
+	return s
+}
+
+// saveStats stores the statistics, called every minute
+func (c *FanController) saveStats(ctx context.Context) {
+	if c.store == nil {
+		return
+	}
+	value, err := json.Marshal(c.Stats())
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal %s stats: %v", c.Name(), err)
+		return
+	}
+	if err := c.store.SaveState(ctx, "fan", c.topic("stats"), string(value)); err != nil {
+		log.Printf("[ERROR] Failed to store %s stats: %v", c.Name(), err)
+	}
+}
+
+// restoreStats loads the stored statistics, called once at start
+func (c *FanController) restoreStats(ctx context.Context) {
+	if c.store == nil {
+		return
+	}
+	value, err := c.store.LoadState(ctx, "fan", c.topic("stats"))
+	if err != nil || value == "" {
+		log.Printf("[INFO] No stored %s stats, starting over: %v", c.Name(), err)
+		return
+	}
+	var s FanStats
+	if err := json.Unmarshal([]byte(value), &s); err != nil {
+		log.Printf("[ERROR] Can't restore %s stats: %v", c.Name(), err)
+		return
+	}
+	c.mx.Lock()
+	c.stats = s
+	c.mx.Unlock()
+	log.Printf("[INFO] %s stats restored: %.1f running hours, %d starts since %s",
+		c.Name(), float64(s.RunSeconds)/3600, s.Starts, s.Since.Format(time.DateOnly))
+}
+
+// ResetStats starts the statistics over, like after the fan is replaced
+func (c *FanController) ResetStats(ctx context.Context) {
+	c.mx.Lock()
+	c.stats = FanStats{Since: time.Now(), running: c.stats.running}
+	c.mx.Unlock()
+	c.saveStats(ctx)
+	c.event(ctx, FanEvent{Kind: "maintenance", Rule: "stats reset", Duty: c.Duty()})
+}
+
+// fanStats handles GET /fan/stats, returns lifetime statistics of all fans
+func (w *Worker) fanStats(rw http.ResponseWriter, r *http.Request) {
+	out := []FanStats{}
+	for _, f := range w.fans {
+		out = append(out, f.Stats())
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(rw).Encode(out)
+}
+
+// resetFanStats handles POST /fan/stats/reset with {"fan": "name"}, after the fan is replaced
+func (w *Worker) resetFanStats(rw http.ResponseWriter, r *http.Request) {
+	var req fanRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f := w.fanByName(req.Fan)
+	if f == nil {
+		http.Error(rw, fmt.Sprintf("fan %q not found", req.Fan), http.StatusNotFound)
+		return
+	}
+	f.ResetStats(r.Context())
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(f.Stats())
+}
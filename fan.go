@@ -0,0 +1,578 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/parMaster/rpid/config"
+	"github.com/parMaster/rpid/storage"
+	"github.com/parMaster/rpid/storage/model"
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/gpio/gpioreg"
+)
+
+// units of the stored fan topics
+var fanUnits = map[string]string{"temp": "m˚C", "rpm": "rpm", "duty": "%"}
+
+// how much history fan policy gets
+const (
+	policyHistorySeconds = 120
+	policyHistoryMinutes = 60
+)
+
+// FanController drives one fan by its policy, following its own temperature input
+type FanController struct {
+	cfg       config.Fan
+	input     func() (int, error) // reads input temperature, m˚C
+	fan       FanActuator         // nil if ControlPin is not set
+	policy    FanPolicy
+	tach      *Tach      // nil if TachPin is not set
+	tachPin   gpio.PinIn // nil if TachPin is not set
+	stall     *stallDetector
+	kickDuty  int       // duty to restore after kick-start
+	kickUntil time.Time // kick-start of the stalled fan is over, zero if not kicking
+	store     storage.Storer
+	mx        sync.Mutex
+	data      historical   // t, temp - input temperature; revs, rpm - fan speed; duty
+	faults    int          // fan faults detected since start
+	degraded  bool         // fan doesn't follow the command
+	override  *FanOverride // manual mode, nil for auto
+	profiles  []*fanProfile
+	profile   *fanProfile // active profile, nil for default
+	events    []FanEvent  // recent events, oldest first
+	switches  int         // duty changes since start
+	shadows   []*shadowPolicy
+	tuning    *AutotuneResult // latest autotune, nil if it never ran
+	cpu       *cpuStat        // nil if no policy needs CPU load
+	stats     FanStats        // lifetime statistics
+	selftest  *SelfTestResult // latest self-test, nil if it never ran
+	safe      bool            // fan failed the self-test and is kept at full speed
+	busy      string          // autotune or self-test driving the fan, empty if none
+}
+
+// NewFanController creates the fan controller, sysfs is used by fans in cooling mode
+func NewFanController(cfg config.Fan, input func() (int, error), store storage.Storer, sysfs string, history config.History) (*FanController, error) {
+	if err := config.ValidatePID(cfg); err != nil {
+		return nil, err // thresholds suggested from trip points are applied by now
+	}
+	policy, err := NewFanPolicy(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &FanController{
+		cfg:    cfg,
+		input:  input,
+		policy: policy,
+		store:  store,
+		data: historical{
+			"t":    secondly[int](history), // momentary input temperature
+			"temp": minutely[int](history), // input temperature history by minute
+		},
+	}
+
+	for _, p := range cfg.Profiles {
+		fp, err := newFanProfile(cfg, p)
+		if err != nil {
+			return nil, err
+		}
+		c.profiles = append(c.profiles, fp)
+	}
+
+	if needsLoad(cfg) {
+		c.cpu = newCPUStat()
+		c.data["load"] = secondly[int](history) // CPU utilisation by second
+	}
+
+	for _, sh := range cfg.Shadow {
+		sp, err := newShadowPolicy(cfg, sh)
+		if err != nil {
+			return nil, err
+		}
+		c.shadows = append(c.shadows, sp)
+	}
+
+	if cfg.Mode == "cooling" {
+		if c.fan, err = NewCoolingFan(sysfs, cfg.CoolingDevice); err != nil {
+			return nil, err
+		}
+		c.data["duty"] = minutely[int](history)
+	} else if cfg.ControlPin != "" {
+		pin := gpioreg.ByName(cfg.ControlPin)
+		if pin == nil {
+			return nil, fmt.Errorf("failed to find %s", cfg.ControlPin)
+		}
+		if c.fan, err = NewFanActuator(pin, cfg); err != nil {
+			return nil, err
+		}
+		c.data["duty"] = minutely[int](history)
+	}
+
+	if cfg.TachPin != "" {
+		if c.tachPin = gpioreg.ByName(cfg.TachPin); c.tachPin == nil {
+			return nil, fmt.Errorf("failed to find %s", cfg.TachPin)
+		}
+		c.tach = NewTach(cfg.PPR, time.Duration(cfg.TachFilter)*time.Microsecond)
+		c.data["revs"] = secondly[int](history) // rpm by second
+		c.data["rpm"] = minutely[int](history)  // rpm history by minute
+		if c.fan != nil {
+			c.stall = newStallDetector(cfg.Stall)
+		}
+	}
+
+	return c, nil
+}
+
+// needsLoad reports if the fan, its profiles or shadow policies use feed-forward
+func needsLoad(cfg config.Fan) bool {
+	if cfg.FeedForward.Gain != 0 {
+		return true
+	}
+	for _, p := range cfg.Profiles {
+		if p.FeedForward != nil && p.FeedForward.Gain != 0 {
+			return true
+		}
+	}
+	for _, sh := range cfg.Shadow {
+		if sh.FeedForward != nil && sh.FeedForward.Gain != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Name of the fan, "fan" for the single fan configured in fan section
+func (c *FanController) Name() string {
+	if c.cfg.Name == "" {
+		return "fan"
+	}
+	return c.cfg.Name
+}
+
+// topic is the fan topic name in storage and /fullData.
+// Single fan configured in fan section uses plain topics, as it always did
+func (c *FanController) topic(t string) string {
+	if c.cfg.Name == "" {
+		return t
+	}
+	return c.cfg.Name + "_" + t
+}
+
+// Run starts tachometer and fan control, blocks until ctx is done
+func (c *FanController) Run(ctx context.Context) {
+	go c.countRevs(ctx)
+	c.control(ctx)
+}
+
+func (c *FanController) control(ctx context.Context) {
+	if c.fan == nil {
+		log.Printf("[INFO] No ControlPin defined for %s, skipping fan control", c.Name())
+		return
+	}
+	time.Sleep(1 * time.Second)
+
+	period := c.activePolicy().Period()
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("[DEBUG] Leaving the %s ON is always safer", c.Name())
+			if err := c.fan.Halt(); err != nil {
+				log.Printf("[ERROR] Halting %s control: %e", c.Name(), err)
+			}
+			return
+		case <-ticker.C:
+		}
+		c.step(ctx, time.Now())
+
+		// policy of the profile switched to runs at its own rate
+		if p := c.activePolicy().Period(); p != period {
+			log.Printf("[DEBUG] %s control period changed to %v", c.Name(), p)
+			period = p
+			ticker.Reset(period)
+		}
+	}
+}
+
+// step runs the policy of the active profile once and applies its decision,
+// unless the fan is overridden. Critical temperature and safe mode beat both
+func (c *FanController) step(ctx context.Context, now time.Time) (d FanDecision) {
+	policy := c.switchProfile(ctx, now)
+	h := c.history(now)
+
+	if temp, ok := c.critical(); ok {
+		d = FanDecision{Duty: 100, Rule: "critical", Inputs: map[string]int{"t": temp}}
+		c.apply(ctx, now, d)
+		return d
+	}
+
+	if c.safeMode() {
+		d = FanDecision{Duty: 100, Rule: "safe mode"}
+		c.apply(ctx, now, d)
+		return d
+	}
+
+	if o := c.activeOverride(ctx, now); o != nil {
+		c.setDuty(o.Duty)
+		return FanDecision{Duty: o.Duty, Rule: "override " + o.Mode}
+	}
+
+	d = c.capDuty(policy.Decide(h))
+	log.Printf("[DEBUG] %s policy decision: %+v", c.Name(), d)
+	c.apply(ctx, now, d)
+	return d
+}
+
+// apply sets the decided duty, recording the change as event
+func (c *FanController) apply(ctx context.Context, now time.Time, d FanDecision) {
+	if d.Keep || d.Duty == c.effectiveDuty() {
+		return
+	}
+	if err := c.setDuty(d.Duty); err == nil {
+		c.event(ctx, FanEvent{Time: now, Kind: "decision", Rule: d.Rule, Duty: d.Duty, Inputs: d.Inputs,
+			FeedForward: d.FeedForward})
+	}
+}
+
+func (c *FanController) setDuty(duty int) error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if !c.kickUntil.IsZero() {
+		c.kickDuty = duty // applied when kick-start is over
+		return nil
+	}
+	if c.fan.Duty() == duty {
+		return nil
+	}
+	if err := c.fan.SetDuty(duty); err != nil {
+		log.Printf("[ERROR] Changing %s duty (%d%%): %e", c.Name(), duty, err)
+		return err
+	}
+	log.Printf("[DEBUG] %s set to %d%%", c.Name(), duty)
+	c.switches++
+	return nil
+}
+
+// effectiveDuty returns the duty the fan is commanded to, the one to restore after kick-start while kicking
+func (c *FanController) effectiveDuty() int {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if !c.kickUntil.IsZero() {
+		return c.kickDuty
+	}
+	return c.fan.Duty()
+}
+
+// Duty returns current fan duty, 0 if fan control is not configured
+func (c *FanController) Duty() int {
+	if c.fan == nil {
+		return 0
+	}
+	return c.fan.Duty()
+}
+
+// history copies recent input temperature history for the fan policy
+func (c *FanController) history(now time.Time) TempHistory {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return TempHistory{
+		Seconds: c.data["t"].Tail(policyHistorySeconds),
+		// restored minutes from before a long downtime are too old to decide on
+		Minutes: c.data["temp"].Since(now.Add(-policyHistoryMinutes * time.Minute)),
+		Load:    c.series("load").Tail(policyHistorySeconds),
+	}
+}
+
+func (c *FanController) countRevs(ctx context.Context) {
+	if c.tach == nil {
+		log.Printf("[INFO] No tachymeter configured for %s", c.Name())
+		return
+	}
+
+	// Set pin as input, with an internal pull-up resistor:
+	if err := c.tachPin.In(gpio.PullUp, gpio.RisingEdge); err != nil {
+		log.Printf("[ERROR] %s tachymeter: %v", c.Name(), err)
+		return
+	}
+
+	// Count every pulse or exit
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("[DEBUG] Halting %s tachymeter", c.Name())
+			if err := c.tachPin.Halt(); err != nil {
+				log.Printf("[ERROR] Halting tachymeter: %e", err)
+			}
+			return
+		default:
+		}
+		if c.tachPin.WaitForEdge(time.Second) {
+			c.tach.Edge(time.Now())
+		}
+	}
+}
+
+// sample reads input temperature and fan speed, called every second
+func (c *FanController) sample(ctx context.Context, now time.Time) {
+	temp, err := c.input()
+	if err != nil {
+		log.Printf("[ERROR] Can't read %s input %s: %v", c.Name(), c.cfg.Input, err)
+	}
+
+	var rpm TachReading
+	if c.tach != nil {
+		rpm = c.tach.Take(now)
+	}
+
+	var load int
+	if c.cpu != nil {
+		if load, err = c.cpu.Utilisation(); err != nil {
+			log.Printf("[ERROR] Can't read CPU utilisation for %s: %v", c.Name(), err)
+		}
+	}
+
+	c.mx.Lock()
+	c.data["t"].Add(now, temp)
+	if c.cpu != nil {
+		c.data["load"].Add(now, load)
+	}
+	if c.tach != nil {
+		c.data["revs"].Add(now, rpm.RPM)
+	}
+	alert := c.countStats(now, rpm.RPM)
+	c.mx.Unlock()
+
+	if alert {
+		c.event(ctx, FanEvent{Time: now, Kind: "maintenance",
+			Rule: fmt.Sprintf("%d running hours, replace the fan", c.cfg.MaintenanceHours), Duty: c.Duty()})
+	}
+
+	if c.stall != nil {
+		c.checkStall(ctx, now, rpm.RPM)
+	}
+	c.shadowStep(ctx, now)
+}
+
+// aggregate measurements by second to data by minute, called every minute
+func (c *FanController) aggregate(ctx context.Context, now time.Time) {
+	c.mx.Lock()
+	if c.tach != nil {
+		c.data["rpm"].Add(now, avg(c.data["revs"].Window(time.Minute)))
+	}
+	if c.fan != nil {
+		c.data["duty"].Add(now, c.Duty())
+	}
+	c.data["temp"].Add(now, avg(c.data["t"].Window(time.Minute)))
+
+	write := map[string]int{}
+	if c.cfg.Name != "" {
+		write["temp"] = c.data["temp"].LastValue()
+	}
+	if c.tach != nil {
+		write["rpm"] = c.data["rpm"].LastValue()
+	}
+	if c.fan != nil {
+		write["duty"] = c.data["duty"].LastValue()
+	}
+	c.mx.Unlock()
+
+	log.Printf("%s: %d rpm, %d%% duty\r\n", c.Name(), write["rpm"], write["duty"])
+
+	c.saveStats(ctx)
+	if c.store == nil {
+		return
+	}
+	for topic, v := range write {
+		d := model.Data{Module: "main", Time: now, Topic: c.topic(topic), Value: float64(v), Unit: fanUnits[topic]}
+		if err := c.store.Write(ctx, d); err != nil {
+			log.Printf("[ERROR] Failed to store %s %s: %v", c.Name(), topic, err)
+		}
+	}
+}
+
+// Status is the fan state for /status
+func (c *FanController) Status() map[string]interface{} {
+	policy := c.activePolicy()
+	profile := c.ProfileName()
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	s := map[string]interface{}{
+		"policy":  policy.Name(),
+		"profile": profile,
+		"temp":    c.data["temp"].LastValue() / 1000,
+		"rpm":     c.series("rpm").LastValue(),
+		"duty":    c.Duty(),
+		"fan":     "ok",
+		"faults":  c.faults,
+		"mode":    FanAuto,
+	}
+	if c.degraded {
+		s["fan"] = "degraded"
+	}
+	if c.stats.Maintenance {
+		s["maintenance"] = "due"
+	}
+	if c.selftest != nil {
+		s["selftest"] = "passed"
+		switch {
+		case c.selftest.Running:
+			s["selftest"] = "running"
+		case !c.selftest.Passed:
+			s["selftest"] = "failed"
+		}
+	}
+	if c.override != nil {
+		s["mode"] = c.override.Mode
+		if !c.override.Until.IsZero() {
+			s["until"] = c.override.Until
+		}
+	}
+	if c.safe {
+		s["mode"] = "safe"
+	}
+	return s
+}
+
+// Report is the fan data for /fullData, keyed by fan topics
+func (c *FanController) Report() map[string]*Series[int] {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	out := map[string]*Series[int]{}
+	for k, v := range c.data {
+		if k == "t" || k == "revs" || k == "load" || (k == "temp" && c.cfg.Name == "") {
+			continue // single fan follows CPU temperature, already reported
+		}
+		out[c.topic(k)] = v.Clone()
+	}
+	return out
+}
+
+// Restore prefills minute history with the stored fan topics, oldest first. Unnamed fan shares
+// temp topic with CPU temperature, it's restored only if the fan follows thermal_zone0
+func (c *FanController) Restore(data []model.Data) {
+	topics := []string{"rpm", "duty"}
+	if c.cfg.Name != "" || c.cfg.Input == "" || c.cfg.Input == "thermal_zone0" {
+		topics = append(topics, "temp")
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	for _, d := range data {
+		for _, k := range topics {
+			if s, ok := c.data[k]; ok && d.Topic == c.topic(k) {
+				restorePoint(s, d, toInt)
+			}
+		}
+	}
+}
+
+// series returns the fan data series, empty one if the fan doesn't measure it
+func (c *FanController) series(topic string) *Series[int] {
+	if s, ok := c.data[topic]; ok {
+		return s
+	}
+	return &Series[int]{}
+}
+
+// PolicyReport is the fan policy name and its state, if it reports one
+func (c *FanController) PolicyReport() map[string]interface{} {
+	policy := c.activePolicy()
+	out := map[string]interface{}{"Policy": policy.Name(), "Profile": c.ProfileName()}
+	if ff, ok := policy.(*feedForwardPolicy); ok {
+		policy = ff.Unwrap()
+	}
+	if r, ok := policy.(PolicyReporter); ok {
+		out["State"] = r.Report()
+	}
+	return out
+}
+
+// fanInput returns the function reading fan input temperature, m˚C
+func (w *Worker) fanInput(cfg config.Fan) func() (int, error) {
+	return w.tempInput(cfg.Input, cfg.InputScale)
+}
+
+// tempInput returns the function reading temperature, m˚C.
+// Input is either a thermal zone name (thermal_zone0 if empty) or a module topic, like bmp280/temp.
+// Module topic value is multiplied by scale, 1 if not set
+func (w *Worker) tempInput(input string, scale float64) func() (int, error) {
+	if input == "" {
+		input = "thermal_zone0"
+	}
+	module, topic, found := strings.Cut(input, "/")
+	if !found {
+		sysfs := w.sysfs()
+		return func() (int, error) { return readThermalZone(sysfs, input) }
+	}
+
+	if scale == 0 {
+		scale = 1
+	}
+	return func() (int, error) {
+		v, err := w.modules.Last(module, topic)
+		return int(v * scale), err
+	}
+}
+
+// loadFans creates controllers for all configured fans
+func (w *Worker) loadFans() {
+	for _, cfg := range w.config.FanList() {
+		cfg = w.suggestThresholds(cfg)
+		c, err := NewFanController(cfg, w.fanInput(cfg), w.store, w.sysfs(), w.config.History)
+		if err != nil {
+			log.Printf("[ERROR] Failed to load %s: %v", cfg.Name, err)
+			continue
+		}
+		c.restoreStats(w.ctx)
+		w.fans = append(w.fans, c)
+		control := cfg.ControlPin
+		if cfg.Mode == "cooling" {
+			control = cfg.CoolingDevice
+		}
+		log.Printf("Fan %s: tach on %s, control on %s (%s), input %s, policy %s, low=%d˚C, high=%d˚C",
+			c.Name(), cfg.TachPin, control, cfg.Mode, cfg.Input, c.policy.Name(), cfg.Low, cfg.High)
+	}
+}
+
+// suggestThresholds sets fan high and low from the trip points of its input thermal zone, if both are unset
+func (w *Worker) suggestThresholds(cfg config.Fan) config.Fan {
+	if !cfg.TripThresholds() {
+		return cfg
+	}
+	zone := cfg.Input
+	if zone == "" {
+		zone = "thermal_zone0"
+	}
+	zones, err := readThermalZones(w.sysfs())
+	if err != nil {
+		log.Printf("[WARN] Can't read thermal zones: %v", err)
+		return cfg
+	}
+	for _, z := range zones {
+		if z.Name != zone {
+			continue
+		}
+		high, low, err := z.SuggestThresholds()
+		if err != nil {
+			log.Printf("[WARN] Fan %s thresholds are not set: %v", cfg.Name, err)
+			return cfg
+		}
+		log.Printf("[INFO] Fan %s thresholds from %s (%s) trip points: low=%d˚C, high=%d˚C", cfg.Name, z.Name, z.Type, low, high)
+		cfg.High, cfg.Low = high, low
+		return cfg
+	}
+	log.Printf("[WARN] Fan %s input %s is not found", cfg.Name, zone)
+	return cfg
+}
+
+// sysfs returns the configured sysfs root, /sys by default
+func (w *Worker) sysfs() string {
+	if w.config.Thermal.Sysfs == "" {
+		return "/sys"
+	}
+	return w.config.Thermal.Sysfs
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/parMaster/rpid/config"
+	"github.com/parMaster/rpid/storage/sqlite"
+	"github.com/stretchr/testify/assert"
+	"periph.io/x/conn/v3/gpio"
+)
+
+func Test_FanController(t *testing.T) {
+	temp := 60000
+	input := func() (int, error) { return temp, nil }
+	pin := &testPin{PinIO: gpio.INVALID}
+	cfg := config.Fan{Name: "exhaust", Input: "bmp280/temp", High: 48, Low: 40}
+	policy, err := NewFanPolicy(cfg)
+	assert.NoError(t, err)
+
+	c := &FanController{
+		cfg:    cfg,
+		input:  input,
+		fan:    &onOffFan{pin: pin},
+		policy: policy,
+		data:   testHistory(),
+	}
+	assert.Equal(t, "exhaust", c.Name())
+
+	ctx := context.Background()
+	for i := 0; i < 60; i++ {
+		c.sample(ctx, time.Now())
+	}
+	for i := 0; i < 3; i++ {
+		c.aggregate(ctx, time.Now())
+	}
+
+	d := c.step(ctx, time.Now())
+	assert.Equal(t, "sudden spike", d.Rule)
+	assert.Equal(t, gpio.High, pin.level)
+
+	s := c.Status()
+	assert.Equal(t, 60, s["temp"])
+	assert.Equal(t, 100, s["duty"])
+	assert.Equal(t, "ok", s["fan"])
+
+	// named fan reports its own topics
+	r := c.Report()
+	assert.Equal(t, []int{60000, 60000, 60000}, r["exhaust_temp"].Values())
+	assert.Contains(t, r, "exhaust_duty")
+	assert.NotContains(t, r, "exhaust_t")
+
+	// input failure is no data, fan goes on
+	temp = 0
+	c.input = func() (int, error) { return 0, errors.New("no data") }
+	c.sample(ctx, time.Now())
+	assert.Equal(t, 0, c.data["t"].LastValue())
+
+	// single fan keeps plain topics
+	c.cfg.Name = ""
+	assert.Equal(t, "fan", c.Name())
+	assert.Equal(t, "duty", c.topic("duty"))
+	assert.NotContains(t, c.Report(), "temp")
+}
+
+func Test_ModulesLast(t *testing.T) {
+	r, err := LoadSystemReporter(config.System{Enabled: true}, nil, true, config.History{})
+	assert.NoError(t, err)
+	m := Modules{r}
+
+	_, err = m.Last("system", "la5m")
+	assert.Error(t, err)
+
+	assert.NoError(t, r.Collect(context.Background()))
+	v, err := m.Last("system", "la5m")
+	assert.NoError(t, err)
+	assert.Equal(t, 0.24, v)
+
+	_, err = m.Last("bmp280", "temp")
+	assert.Error(t, err)
+}
+
+func Test_FanOverride(t *testing.T) {
+	pin := &testPin{PinIO: gpio.INVALID}
+	policy, err := NewFanPolicy(config.Fan{High: 48, Low: 40})
+	assert.NoError(t, err)
+	c := &FanController{
+		input:  func() (int, error) { return 60000, nil },
+		fan:    &onOffFan{pin: pin},
+		policy: policy,
+		data:   testHistory(),
+	}
+	ctx := context.Background()
+
+	_, err = c.SetOverride(ctx, "fast", 0, 0)
+	assert.Error(t, err)
+	_, err = c.SetOverride(ctx, FanDuty, 120, 0)
+	assert.Error(t, err)
+
+	// forced off survives the control loop
+	o, err := c.SetOverride(ctx, FanOff, 0, time.Hour)
+	assert.NoError(t, err)
+	assert.False(t, o.Until.IsZero())
+	assert.Equal(t, gpio.Low, pin.level)
+	d := c.step(ctx, time.Now())
+	assert.Equal(t, "override off", d.Rule)
+	assert.Equal(t, 0, c.Duty())
+	assert.Equal(t, FanOff, c.Status()["mode"])
+
+	// expired override returns the fan to its policy
+	c.mx.Lock()
+	c.override.Until = time.Now().Add(-time.Second)
+	c.mx.Unlock()
+	d = c.step(ctx, time.Now())
+	assert.Equal(t, "no data", d.Rule)
+	assert.Equal(t, 100, c.Duty())
+	assert.Equal(t, FanAuto, c.Override().Mode)
+
+	_, err = c.SetOverride(ctx, FanOn, 0, 0)
+	assert.NoError(t, err)
+	assert.True(t, c.Override().Until.IsZero())
+	_, err = c.SetOverride(ctx, FanAuto, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "auto", c.Status()["mode"])
+
+	// critical temperature keeps the fan on, override waits for it to cool down
+	c.data["t"].Add(time.Now(), 85000)
+	_, err = c.SetOverride(ctx, FanOff, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, gpio.High, pin.level)
+	assert.Equal(t, FanOff, c.Override().Mode)
+	c.data["t"].Add(time.Now(), 50000)
+
+	// override that can't be applied isn't kept
+	pin.broken = true
+	_, err = c.SetOverride(ctx, FanOn, 0, 0)
+	assert.NoError(t, err, "fan is on already")
+	_, err = c.SetOverride(ctx, FanDuty, 0, 0)
+	assert.Error(t, err)
+	assert.Equal(t, FanOn, c.Override().Mode)
+}
+
+func Test_FanEvents(t *testing.T) {
+	pin := &testPin{PinIO: gpio.INVALID}
+	policy, err := NewFanPolicy(config.Fan{Name: "case", High: 48, Low: 40})
+	assert.NoError(t, err)
+	c := &FanController{
+		cfg:    config.Fan{Name: "case"},
+		fan:    &onOffFan{pin: pin},
+		policy: policy,
+		data:   testHistory(),
+	}
+	ctx := context.Background()
+
+	// only transitions are recorded
+	c.step(ctx, time.Now())
+	c.step(ctx, time.Now())
+	events := c.Events()
+	assert.Len(t, events, 1)
+	assert.Equal(t, "case", events[0].Fan)
+	assert.Equal(t, "decision", events[0].Kind)
+	assert.Equal(t, "no data", events[0].Rule)
+	assert.Equal(t, 100, events[0].Duty)
+
+	_, err = c.SetOverride(ctx, FanOff, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "override", c.Events()[1].Kind)
+
+	for i := 0; i < fanEventsLimit; i++ {
+		c.event(ctx, FanEvent{Kind: "fault", Rule: FaultStall})
+	}
+	assert.Len(t, c.Events(), fanEventsLimit)
+}
+
+func Test_FanProfiles(t *testing.T) {
+	cfg := config.Fan{High: 48, Low: 40, Critical: 70, Profiles: []config.Profile{
+		{Name: "quiet", Days: []string{"fri"}, From: "22:00", To: "07:00", Tuning: config.Tuning{MaxDuty: 40}},
+	}}
+	p, err := newFanProfile(cfg, cfg.Profiles[0])
+	assert.NoError(t, err)
+
+	fri := time.Date(2023, 6, 2, 0, 0, 0, 0, time.Local)
+	assert.False(t, p.Active(fri.Add(21*time.Hour+59*time.Minute)))
+	assert.True(t, p.Active(fri.Add(22*time.Hour)))
+	assert.True(t, p.Active(fri.Add(30*time.Hour))) // saturday morning
+	assert.False(t, p.Active(fri.Add(31*time.Hour)))
+	assert.False(t, p.Active(fri.Add(-1*time.Hour))) // thursday night
+
+	pin := &testPin{PinIO: gpio.INVALID, noPWM: true}
+	fan, err := NewFanActuator(pin, config.Fan{Mode: "pwm"})
+	assert.NoError(t, err)
+	policy, err := NewFanPolicy(cfg)
+	assert.NoError(t, err)
+	c := &FanController{
+		cfg:      cfg,
+		fan:      fan,
+		policy:   policy,
+		profiles: []*fanProfile{p},
+		profile:  p,
+		data:     testHistory(),
+	}
+	defer fan.Halt()
+	ctx := context.Background()
+
+	// quiet profile caps the "no data" full speed
+	d := c.capDuty(c.policy.Decide(c.history(time.Now())))
+	assert.Equal(t, 40, d.Duty)
+	assert.Equal(t, "no data, capped by quiet", d.Rule)
+	assert.Equal(t, "quiet", c.Status()["profile"])
+
+	// critical temperature beats the cap and manual mode
+	c.data["t"].Add(time.Now(), 71000)
+	_, err = c.SetOverride(ctx, FanOff, 0, 0)
+	assert.NoError(t, err)
+	d = c.step(ctx, time.Now())
+	assert.Equal(t, "critical", d.Rule)
+	assert.Equal(t, 100, c.Duty())
+}
+
+func Test_FanShadow(t *testing.T) {
+	cfg := config.Fan{High: 48, Low: 40, Shadow: []config.Shadow{
+		{Name: "quiet", Tuning: config.Tuning{MaxDuty: 30}},
+		{Name: "pid", Tuning: config.Tuning{Policy: "pid", PID: &config.PID{Setpoint: 45, Kp: 5}}},
+	}}
+	policy, err := NewFanPolicy(cfg)
+	assert.NoError(t, err)
+	c := &FanController{
+		cfg:    cfg,
+		fan:    &onOffFan{pin: &testPin{PinIO: gpio.INVALID}},
+		policy: policy,
+		data:   testHistory(),
+	}
+	for _, sh := range cfg.Shadow {
+		sp, err := newShadowPolicy(cfg, sh)
+		assert.NoError(t, err)
+		c.shadows = append(c.shadows, sp)
+	}
+	ctx := context.Background()
+
+	// no data, every policy runs the fan, quiet one is capped.
+	// Shadows decide at their own period: hysteresis every 10s, PID every 5s
+	start := time.Now()
+	for i := 0; i < 40; i++ {
+		now := start.Add(time.Duration(i) * time.Second)
+		if i%10 == 0 {
+			c.step(ctx, now)
+		}
+		c.shadowStep(ctx, now)
+	}
+	s := c.ShadowSummary()
+	assert.Len(t, s, 2)
+	assert.Equal(t, "quiet", s[0].Name)
+	assert.Equal(t, "hysteresis", s[0].Policy)
+	assert.Equal(t, 4, s[0].Decisions)
+	assert.Equal(t, 8, s[1].Decisions)
+	assert.Equal(t, ShortFloat(0), s[0].Agreement)
+	assert.Equal(t, 1, s[0].Switches)
+	assert.Equal(t, 1, s[0].ActualSwitches)
+	assert.Equal(t, ShortFloat(30), s[0].EstimatedDuty)
+	assert.Equal(t, ShortFloat(100), s[0].ActualDuty)
+	assert.Equal(t, "pid", s[1].Policy)
+	assert.Equal(t, ShortFloat(1), s[1].Agreement)
+
+	_, err = newShadowPolicy(cfg, config.Shadow{Name: "bad", Tuning: config.Tuning{Policy: "curve"}})
+	assert.Error(t, err)
+}
+
+func Test_FanStats(t *testing.T) {
+	ctx := context.Background()
+	store, err := sqlite.NewStorage(ctx, filepath.Join(t.TempDir(), "stats.db"))
+	assert.NoError(t, err)
+	_, _, err = store.Migrate(ctx, false)
+	assert.NoError(t, err)
+
+	cfg := config.Fan{Name: "exhaust", High: 48, Low: 40, MaintenanceHours: 1}
+	policy, err := NewFanPolicy(cfg)
+	assert.NoError(t, err)
+	newFan := func() *FanController {
+		return &FanController{
+			cfg:    cfg,
+			input:  func() (int, error) { return 50000, nil },
+			fan:    &onOffFan{pin: &testPin{PinIO: gpio.INVALID}},
+			policy: policy,
+			store:  store,
+			data:   testHistory(),
+		}
+	}
+	c := newFan()
+	c.restoreStats(ctx) // nothing stored yet
+
+	now := time.Now()
+	c.sample(ctx, now) // stopped
+	c.setDuty(40)
+	for i := 0; i < 1800; i++ {
+		c.sample(ctx, now.Add(time.Duration(i)*time.Second))
+	}
+	c.setDuty(0)
+	c.sample(ctx, now)
+	c.setDuty(100)
+	for i := 0; i < 1800; i++ {
+		c.sample(ctx, now.Add(time.Duration(i)*time.Second))
+	}
+
+	s := c.Stats()
+	assert.Equal(t, "exhaust", s.Fan)
+	assert.Equal(t, 2, s.Starts)
+	assert.Equal(t, 1.0, s.RunHours)
+	assert.Equal(t, 100.0, s.AvgDuty) // onoff fan runs at 100% whatever the duty asked
+	assert.True(t, s.Maintenance)
+	assert.Equal(t, "due", c.Status()["maintenance"])
+	events := c.Events()
+	assert.Equal(t, "maintenance", events[len(events)-1].Kind)
+
+	// restart picks up where it left
+	c.aggregate(ctx, time.Now())
+	restarted := newFan()
+	restarted.restoreStats(ctx)
+	r := restarted.Stats()
+	assert.Equal(t, s.RunSeconds, r.RunSeconds)
+	assert.Equal(t, s.Starts, r.Starts)
+	assert.True(t, r.Since.Equal(s.Since))
+	assert.True(t, r.Maintenance)
+
+	restarted.ResetStats(ctx)
+	assert.Zero(t, restarted.Stats().RunSeconds)
+	assert.False(t, restarted.Stats().Maintenance)
+}
+
+// testHistory is the data of the fan with control pin and no tachymeter
+func testHistory() historical {
+	return historical{"t": secondly[int](config.History{}), "temp": minutely[int](config.History{}), "duty": minutely[int](config.History{})}
+}
@@ -9,7 +9,6 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
 	"sync"
 	"syscall"
 	"time"
@@ -23,18 +22,19 @@ import (
 	"github.com/parMaster/rpid/storage/model"
 	"github.com/parMaster/rpid/web"
 	flags "github.com/umputun/go-flags"
-	"periph.io/x/conn/v3/gpio"
-	"periph.io/x/conn/v3/gpio/gpioreg"
 	"periph.io/x/conn/v3/i2c"
 	"periph.io/x/conn/v3/i2c/i2creg"
 	"periph.io/x/host/v3"
 )
 
-type historical map[string][]int
+// historical is the set of measurement series by topic
+type historical map[string]*Series[int]
 
 type Worker struct {
 	config  config.Parameters
-	revs    int // persistent revs counter
+	fans    []*FanController
+	cpufreq *CPUFreqAction  // nil if not enabled
+	guard   *EmergencyGuard // nil if not enabled
 	data    historical
 	i2cBus  i2c.BusCloser
 	modules Modules
@@ -47,8 +47,8 @@ type Worker struct {
 func NewWorker(config *config.Parameters) *Worker {
 	data := historical{
 		// CPU Temperature in milliCentigrades
-		"t":    {}, // momentary temp
-		"temp": {}, // temp history by minute
+		"t":    secondly[int](config.History), // momentary temp
+		"temp": minutely[int](config.History), // temp history by minute
 	}
 
 	w := &Worker{
@@ -61,6 +61,15 @@ func NewWorker(config *config.Parameters) *Worker {
 }
 
 func (w *Worker) Run(ctx context.Context) error {
+	if err := w.start(ctx); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	return w.stop()
+}
+
+// start loads storage, peripherals, modules and fans and starts the service loops
+func (w *Worker) start(ctx context.Context) error {
 	var err error
 	w.ctx = ctx
 
@@ -84,20 +93,41 @@ func (w *Worker) Run(ctx context.Context) error {
 	w.loadModules()
 	log.Printf("[DEBUG] Loaded modules: %s", w.modules)
 
-	go w.controlFan(ctx)
-	go w.startTach(ctx)
+	w.loadFans()
+	w.warmStart(ctx)
+	for _, f := range w.fans {
+		go f.Run(ctx)
+		if f.cfg.SelfTest.OnStart {
+			go func(f *FanController) {
+				if _, err := f.SelfTest(ctx); err != nil {
+					log.Printf("[ERROR] Self-test of %s: %v", f.Name(), err)
+				}
+			}(f)
+		}
+	}
+
+	if c := w.config.Thermal.CPUFreq; c.Enabled {
+		w.cpufreq = NewCPUFreqAction(c, w.sysfs(), w.tempInput(c.Input, c.InputScale), w.store)
+		go w.cpufreq.Run(ctx)
+	}
+	if e := w.config.Thermal.Emergency; e.Enabled {
+		w.guard = NewEmergencyGuard(e, w.tempInput(e.Input, e.InputScale), w.store)
+		go w.guard.Run(ctx)
+	}
 
 	go w.logEverySecond(ctx)
 	go w.logEveryMinute(ctx)
 	go w.startServer(ctx)
 
-	log.Printf("Service started. Fan tach on %s, trigger on %s, listening to \"%s\"", w.config.Fan.TachPin, w.config.Fan.ControlPin, w.config.Server.Listen)
-	log.Printf("Temps cfg: low=%d˚C, high=%d˚C", w.config.Fan.Low, w.config.Fan.High)
+	log.Printf("Service started. Fans: %d, listening to \"%s\"", len(w.fans), w.config.Server.Listen)
 	if w.store != nil {
 		log.Printf("Storage: %s, %s", w.config.Storage.Type, w.config.Storage.Path)
 	}
+	return nil
+}
 
-	<-ctx.Done()
+// stop releases peripherals, once the service context is done
+func (w *Worker) stop() error {
 	time.Sleep(2 * time.Second) // wait 2 secs till tach timeout (1 sec) hits
 	if w.i2cBus != nil {
 		log.Println("[DEBUG] Closing I²C Bus on exit")
@@ -109,114 +139,6 @@ func (w *Worker) Run(ctx context.Context) error {
 	return nil
 }
 
-func (w *Worker) setFanState(fanControl gpio.PinIO, state bool) error {
-	if err := fanControl.Out(gpio.Level(state)); err != nil {
-		log.Printf("[ERROR] Changing fan state (%v): %e", state, err)
-		return err
-	}
-	log.Printf("[DEBUG] Fan set to %v", gpio.Level(state))
-	return nil
-}
-
-func (w *Worker) controlFan(ctx context.Context) {
-	if w.config.Fan.ControlPin == "" {
-		log.Println("[INFO] No fan ControlPin defined, skipping fan control")
-		return
-	}
-	fanControl := gpioreg.ByName(w.config.Fan.ControlPin)
-	if fanControl == nil {
-		log.Printf("[ERROR] Failed to find %s", fanControl)
-	}
-	time.Sleep(1 * time.Second)
-
-	tempHigh := w.config.Fan.High * 1000 // fan   activation temperature m˚C
-	tempLow := w.config.Fan.Low * 1000   // fan DEactivation temperature m˚C
-	ticker := time.NewTicker(10 * time.Second)
-	for {
-		select {
-		case <-ctx.Done():
-			log.Println("[DEBUG] Leaving the fan ON is always safer")
-			fanControl.Out(gpio.High)
-			fanControl.Halt()
-			return
-		case <-ticker.C:
-		}
-
-		w.mx.Lock()
-		ma10sec, ma30sec, ma1min, ma3min := 0, 0, last(w.data["temp"]), 0
-		if len(w.data["t"]) >= 10 {
-			ma10sec = avg(w.data["t"][max(0, len(w.data["t"])-9) : len(w.data["t"])-1])
-		}
-		log.Printf("[DEBUG] 10 seconds moving average: %d", ma10sec)
-
-		if len(w.data["t"]) >= 30 {
-			ma30sec = avg(w.data["t"][max(0, len(w.data["t"])-29) : len(w.data["t"])-1])
-		}
-		log.Printf("[DEBUG] 30 seconds moving average: %d", ma30sec)
-
-		log.Printf("[DEBUG] 1 minute moving average: %d", ma1min)
-
-		if len(w.data["temp"]) >= 3 {
-			ma3min = avg(w.data["temp"][max(0, len(w.data["temp"])-2) : len(w.data["temp"])-1])
-		}
-		log.Printf("[DEBUG] 3 minutes moving average: %d", ma3min)
-		w.mx.Unlock()
-
-		// Fan activation conditions
-		if ma10sec > tempHigh+10000 || // Sudden spike
-			ma30sec > tempHigh+5000 || // Fast rise
-			ma1min > tempHigh || // High temperature
-			ma1min == 0 || // No data
-			ma3min == 0 { //  No data
-
-			w.setFanState(fanControl, true)
-			continue
-		}
-
-		// Deactivate otherwise
-		if ma3min < tempLow || // Lower than low for 3 minutes
-			ma1min < tempLow-1000 || // Low enough
-			ma30sec < tempLow-2000 || // Fast decline
-			ma10sec < tempLow-4000 { // Sudden drop
-			w.setFanState(fanControl, false)
-		}
-	}
-}
-
-func (w *Worker) startTach(ctx context.Context) {
-	if w.config.Fan.TachPin == "" {
-		log.Println("[INFO] No tachymeter configured")
-		return
-	}
-	w.data["revs"] = []int{}
-	w.data["rpm"] = []int{}
-	var tach gpio.PinIn = gpioreg.ByName(w.config.Fan.TachPin)
-	if tach == nil {
-		log.Fatalf("Failed to find %s", w.config.Fan.TachPin)
-	}
-
-	// Set pin as input, with an internal pull-up resistor:
-	if err := tach.In(gpio.PullUp, gpio.RisingEdge); err != nil {
-		log.Fatal(err)
-	}
-
-	// Count every rev or exit
-	for {
-		select {
-		case <-ctx.Done():
-			log.Println("[DEBUG] Halting tachymeter")
-			if err := tach.Halt(); err != nil {
-				log.Printf("[ERROR] Halting tachymeter: %e", err)
-			}
-			return
-		default:
-		}
-		if tach.WaitForEdge(time.Second) {
-			w.revs++
-		}
-	}
-}
-
 func (w *Worker) startServer(ctx context.Context) {
 	httpServer := &http.Server{
 		Addr:              w.config.Server.Listen,
@@ -242,16 +164,58 @@ func (w *Worker) router() http.Handler {
 
 	router.Get("/status", func(rw http.ResponseWriter, r *http.Request) {
 		w.mx.Lock()
-		resp := map[string]int{
-			"temp": last(w.data["temp"]) / 1000,
-			"rpm":  last(w.data["rpm"]),
+		resp := map[string]interface{}{
+			"temp":    w.data["temp"].LastValue() / 1000,
+			"rpm":     0,
+			"duty":    0,
+			"fan":     "ok",
+			"faults":  0,
+			"mode":    FanAuto,
+			"profile": "default",
 		}
 		w.mx.Unlock()
 
+		fans := map[string]interface{}{}
+		for i, f := range w.fans {
+			status := f.Status()
+			fans[f.Name()] = status
+			if i == 0 { // first fan is reported at the top level, as it always was
+				for _, k := range []string{"rpm", "duty", "fan", "faults", "mode", "profile"} {
+					resp[k] = status[k]
+				}
+			}
+		}
+		if len(fans) > 0 {
+			resp["fans"] = fans
+		}
+		if w.guard != nil {
+			resp["emergency"] = "ok"
+			if since := w.guard.Active(); !since.IsZero() {
+				resp["emergency"] = "above critical since " + since.Format(time.RFC3339)
+			}
+		}
+		if w.cpufreq != nil {
+			resp["cpufreq"] = "normal"
+			if w.cpufreq.Capped() {
+				resp["cpufreq"] = "capped"
+			}
+		}
+
 		rw.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(rw).Encode(resp)
 	})
 
+	router.Get("/fan", w.fanOverrides)
+	router.Post("/fan", w.setFanOverride)
+	router.Get("/fan/events", w.fanEvents)
+	router.Get("/fan/shadow", w.fanShadow)
+	router.Get("/fan/stats", w.fanStats)
+	router.Post("/fan/stats/reset", w.resetFanStats)
+	router.Get("/fan/selftest", w.selfTestResults)
+	router.Post("/fan/selftest", w.startSelfTest)
+	router.Get("/fan/autotune", w.autotuneResults)
+	router.Post("/fan/autotune", w.startAutotune)
+
 	router.Get("/fullData", func(rw http.ResponseWriter, r *http.Request) {
 		rw.Header().Set("Content-Type", "application/json")
 		rw.Header().Set("Access-Control-Allow-Origin", "*")
@@ -292,17 +256,24 @@ func (w *Worker) router() http.Handler {
 			return
 		}
 
+		from, to, err := viewRange(r, time.Now())
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		rw.Header().Set("Content-Type", "application/json")
 
-		out, err := w.cache.Get(module)
+		key := module + "?" + r.URL.RawQuery
+		out, err := w.cache.Get(key)
 		if err != nil {
-			out, err = w.store.View(w.ctx, module)
+			out, err = w.store.View(w.ctx, module, from, to)
 			if err != nil {
 				log.Printf("[ERROR] Failed to get view: %v", err)
 				rw.WriteHeader(http.StatusInternalServerError)
 				return
 			}
-			w.cache.Set(module, out, 60)
+			w.cache.Set(key, out, 60)
 		}
 		json.NewEncoder(rw).Encode(out)
 	})
@@ -310,6 +281,35 @@ func (w *Worker) router() http.Handler {
 	return router
 }
 
+// viewRange parses from and to query parameters, dates or RFC3339 times. Last 30 days by default,
+// which are read as hourly averages once data is downsampled
+func viewRange(r *http.Request, now time.Time) (from, to time.Time, err error) {
+	parse := func(name string, def time.Time) (time.Time, error) {
+		v := r.URL.Query().Get(name)
+		if v == "" {
+			return def, nil
+		}
+		if t, err := time.ParseInLocation(time.DateOnly, v, time.Local); err == nil {
+			return t, nil
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return t, fmt.Errorf("bad %s %q, expected 2006-01-02 or RFC3339 time", name, v)
+		}
+		return t.Local(), nil
+	}
+	if to, err = parse("to", now); err != nil {
+		return from, to, err
+	}
+	if from, err = parse("from", to.Add(-30*24*time.Hour)); err != nil {
+		return from, to, err
+	}
+	if !from.Before(to) {
+		return from, to, fmt.Errorf("from must be before to")
+	}
+	return from, to, nil
+}
+
 func (w *Worker) responseWithFile(file string, rw http.ResponseWriter) error {
 	var html []byte
 	var err error
@@ -333,18 +333,25 @@ func (w *Worker) getFullData() interface{} {
 	defer w.mx.Unlock()
 
 	var out struct {
-		Data    historical
-		Dates   []string
+		Data    map[string]*Series[int]
 		Modules map[string]interface{}
+		Fans    map[string]interface{} `json:",omitempty"`
+	}
+
+	// every series carries its sample times, missed samples are gaps
+	out.Data = map[string]*Series[int]{
+		"t":    w.data["t"].Latest(policyHistorySeconds), // momentary temperature, recent ones only
+		"temp": w.data["temp"].Clone(),
 	}
 
-	// dates are not stored but generated on the fly
-	out.Data = w.data
-	out.Data["revs"] = []int{}
-	out.Dates = []string{}
-	now := time.Now()
-	for i := len(out.Data["temp"]); i > 0; i-- {
-		out.Dates = append(out.Dates, now.Add(-1*time.Minute*time.Duration(i)).Format("2006-01-02 15:04"))
+	if len(w.fans) > 0 {
+		out.Fans = map[string]interface{}{}
+	}
+	for _, f := range w.fans {
+		for k, v := range f.Report() {
+			out.Data[k] = v
+		}
+		out.Fans[f.Name()] = f.PolicyReport()
 	}
 
 	out.Modules = make(map[string]interface{})
@@ -361,7 +368,6 @@ func (w *Worker) getFullData() interface{} {
 
 func (w *Worker) logEverySecond(ctx context.Context) {
 	ticker := time.NewTicker(1 * time.Second)
-	var temp int
 	for {
 		select {
 		case <-ctx.Done():
@@ -369,28 +375,24 @@ func (w *Worker) logEverySecond(ctx context.Context) {
 		case <-ticker.C:
 		}
 
-		temp = 0
 		// Current temperature as reported by thermal zone (sensor), millidegree Celsius
-		// https://www.kernel.org/doc/Documentation/ABI/testing/sysfs-class-thermal
-		sysTemp, err := os.ReadFile("/sys/class/thermal/thermal_zone0/temp")
+		temp, err := readThermalZone(w.sysfs(), "thermal_zone0")
 		if err != nil {
-			log.Printf("[ERROR] Can't read temperature file: %e", err)
-		} else {
-			temp, err = strconv.Atoi(string(sysTemp[0 : len(sysTemp)-1]))
-			if err != nil {
-				log.Printf("[ERROR] Converting temp data: %e", err)
-			}
+			log.Printf("[ERROR] Can't read temperature: %e", err)
 		}
 
 		if w.config.Server.Dbg {
-			log.Printf("[DEBUG] Temp: %d m˚C | Fan RPS/RPM: %d/%d\r\n", temp, w.revs, w.revs*60)
+			log.Printf("[DEBUG] Temp: %d m˚C\r\n", temp)
 		}
 
+		now := time.Now()
 		w.mx.Lock()
-		w.data["revs"] = append(w.data["revs"], w.revs*60)
-		w.revs = 0
-		w.data["t"] = append(w.data["t"], temp)
+		w.data["t"].Add(now, temp)
 		w.mx.Unlock()
+
+		for _, f := range w.fans {
+			f.sample(ctx, now)
+		}
 	}
 }
 
@@ -404,24 +406,19 @@ func (w *Worker) logEveryMinute(ctx context.Context) {
 		case <-ticker.C:
 		}
 
-		w.mx.Lock()
-		if w.config.Fan.TachPin != "" {
-			w.data["rpm"] = append(w.data["rpm"], avg(w.data["revs"]))
+		now := time.Now()
+		for _, f := range w.fans {
+			f.aggregate(ctx, now)
 		}
-		w.data["revs"] = []int{}
-		w.data["temp"] = append(w.data["temp"], avg(w.data["t"][max(0, len(w.data["t"])-60):len(w.data["t"])-1]))
 
-		// "scrolling" temperature history, leave only last 60-120 seconds
-		if len(w.data["t"]) > 100 {
-			w.data["t"] = w.data["t"][len(w.data["t"])-60 : len(w.data["t"])-1]
-		}
+		w.mx.Lock()
+		w.data["temp"].Add(now, avg(w.data["t"].Window(time.Minute)))
+		temp := w.data["temp"].LastValue()
 
-		log.Printf("CPU: %d m˚C\r\n", last(w.data["temp"]))
-		log.Printf("Fan: %d rpm\r\n", last(w.data["rpm"]))
+		log.Printf("CPU: %d m˚C\r\n", temp)
 
 		if w.store != nil {
-			w.store.Write(ctx, model.Data{Module: "main", Topic: "temp", Value: fmt.Sprint(last(w.data["temp"]))})
-			w.store.Write(ctx, model.Data{Module: "main", Topic: "rpm", Value: fmt.Sprint(last(w.data["rpm"]))})
+			w.store.Write(ctx, model.Data{Module: "main", Time: now, Topic: "temp", Value: float64(temp), Unit: "m˚C"})
 		}
 
 		for _, m := range w.modules {
@@ -439,7 +436,7 @@ func (w *Worker) logEveryMinute(ctx context.Context) {
 func (w *Worker) loadModules() (names []string) {
 
 	if w.config.Modules.System.Enabled {
-		sys, err := LoadSystemReporter(w.config.Modules.System, w.store, w.config.Server.Dbg)
+		sys, err := LoadSystemReporter(w.config.Modules.System, w.store, w.config.Server.Dbg, w.config.History)
 		if err != nil {
 			log.Printf("%e", err)
 		} else {
@@ -449,7 +446,7 @@ func (w *Worker) loadModules() (names []string) {
 	}
 
 	if w.config.Modules.BMP280.Enabled {
-		modbmp280, err := LoadBmp280Reporter(w.config.Modules.BMP280, w.i2cBus, w.store)
+		modbmp280, err := LoadBmp280Reporter(w.config.Modules.BMP280, w.i2cBus, w.store, w.config.History)
 		if err != nil {
 			log.Printf("%e", err)
 		} else {
@@ -459,7 +456,7 @@ func (w *Worker) loadModules() (names []string) {
 	}
 
 	if w.config.Modules.HTU21.Enabled {
-		modhtu21, err := LoadHtu21Reporter(w.config.Modules.HTU21, w.i2cBus)
+		modhtu21, err := LoadHtu21Reporter(w.config.Modules.HTU21, w.i2cBus, w.config.History)
 		if err != nil {
 			log.Printf("%e", err)
 		} else {
@@ -469,7 +466,7 @@ func (w *Worker) loadModules() (names []string) {
 	}
 
 	if w.config.Modules.Smc768.Enabled {
-		modsmc768, err := LoadSmc768Reporter(w.config.Modules.Smc768, w.store, w.config.Server.Dbg)
+		modsmc768, err := LoadSmc768Reporter(w.config.Modules.Smc768, w.store, w.config.Server.Dbg, w.config.History)
 		if err != nil {
 			log.Printf("%e", err)
 		} else {
@@ -478,6 +475,26 @@ func (w *Worker) loadModules() (names []string) {
 		}
 	}
 
+	if w.config.Modules.Throttled.Enabled {
+		modthrottled, err := LoadThrottledReporter(w.config.Modules.Throttled, w.store, w.config.Server.Dbg, w.config.History)
+		if err != nil {
+			log.Printf("%e", err)
+		} else {
+			w.modules = append(w.modules, modthrottled)
+			names = append(names, modthrottled.Name())
+		}
+	}
+
+	if w.config.Modules.Zones.Enabled {
+		modzones, err := LoadZonesReporter(w.config.Modules.Zones, w.sysfs(), w.store, w.config.History)
+		if err != nil {
+			log.Printf("%e", err)
+		} else {
+			w.modules = append(w.modules, modzones)
+			names = append(names, modzones.Name())
+		}
+	}
+
 	return
 }
 
@@ -509,12 +526,17 @@ func avg(slice []int) int {
 type Options struct {
 	Config string `long:"config" env:"CONFIG" default:"config.yml" description:"yaml config file name"`
 	Dbg    bool   `long:"dbg" env:"DEBUG" description:"show debug info"`
+
+	Simulate SimulateCmd `command:"simulate" description:"compare fan policies on the thermal model or a recorded temperature trace"`
+	Autotune AutotuneCmd `command:"autotune" description:"measure fan step response and propose thresholds and PID gains"`
+	Migrate  MigrateCmd  `command:"migrate" description:"show or apply sqlite schema migrations"`
 }
 
 func main() {
 	// Parsing cmd parameters
 	var opts Options
 	p := flags.NewParser(&opts, flags.PassDoubleDash|flags.HelpFlag)
+	p.SubcommandsOptional = true
 	if _, err := p.Parse(); err != nil {
 		if err.(*flags.Error).Type != flags.ErrHelp {
 			fmt.Printf("%v\n", err)
@@ -534,6 +556,25 @@ func main() {
 		conf.Server.Dbg = opts.Dbg
 	}
 
+	if p.Active != nil && p.Active.Name == "simulate" {
+		if err := opts.Simulate.Run(conf, os.Stdout); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if p.Active != nil && p.Active.Name == "migrate" {
+		ctx, cancel := context.WithCancel(context.Background())
+		err := opts.Migrate.Run(ctx, conf, os.Stdout)
+		cancel()
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Logger setup
 	logOpts := []lgr.Option{
 		lgr.LevelBraces,
@@ -561,5 +602,16 @@ func main() {
 		}
 	}()
 
-	NewWorker(conf).Run(ctx)
+	if p.Active != nil && p.Active.Name == "autotune" {
+		err := opts.Autotune.Run(ctx, conf, os.Stdout)
+		cancel()
+		if err != nil {
+			log.Printf("[ERROR] Autotune failed: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	w := NewWorker(conf)
+	w.Run(ctx)
 }
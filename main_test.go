@@ -2,14 +2,17 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/parMaster/rpid/config"
 	"github.com/stretchr/testify/assert"
 )
 
 func Test_SystemReporter(t *testing.T) {
-	r, err := LoadSystemReporter(config.System{Enabled: true}, nil, true)
+	r, err := LoadSystemReporter(config.System{Enabled: true}, nil, true, config.History{})
 	assert.NoError(t, err)
 
 	ctx := context.Background()
@@ -20,27 +23,68 @@ func Test_SystemReporter(t *testing.T) {
 	res, err := r.Report()
 	assert.NoError(t, err)
 
-	expected := Response{
-		TimeInState: map[string]int{
-			"1000": 2349,
-			"1100": 1911,
-			"1200": 1970,
-			"1300": 1799,
-			"1400": 1547,
-			"1500": 1143,
-			"1600": 795,
-			"1700": 746,
-			"1800": 2726,
-			"600":  200116,
-			"700":  35684,
-			"800":  6126,
-			"900":  4051,
-		},
-		LoadAvg: map[string][]ShortFloat{
-			"1m":  {0.12},
-			"5m":  {0.24},
-			"15m": {0.3},
-		}}
-
-	assert.Equal(t, expected, res)
+	expected := map[string]int{
+		"1000": 2349,
+		"1100": 1911,
+		"1200": 1970,
+		"1300": 1799,
+		"1400": 1547,
+		"1500": 1143,
+		"1600": 795,
+		"1700": 746,
+		"1800": 2726,
+		"600":  200116,
+		"700":  35684,
+		"800":  6126,
+		"900":  4051,
+	}
+	assert.Equal(t, expected, res.(Response).TimeInState)
+
+	la := res.(Response).LoadAvg
+	assert.Equal(t, []ShortFloat{0.12}, la["1m"].Values())
+	assert.Equal(t, []ShortFloat{0.24}, la["5m"].Values())
+	assert.Equal(t, []ShortFloat{0.3}, la["15m"].Values())
+}
+
+func Test_ViewRange(t *testing.T) {
+	now := time.Date(2024, 2, 1, 12, 0, 0, 0, time.Local)
+	r := httptest.NewRequest("GET", "/viewData/main", nil)
+	from, to, err := viewRange(r, now)
+	assert.NoError(t, err)
+	assert.Equal(t, now, to)
+	assert.Equal(t, now.Add(-30*24*time.Hour), from)
+
+	r = httptest.NewRequest("GET", "/viewData/main?from=2024-01-01&to=2024-01-02T00:00:00Z", nil)
+	from, to, err = viewRange(r, now)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local), from)
+	assert.True(t, to.Equal(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)))
+
+	for _, q := range []string{"from=yesterday", "from=2024-02-01&to=2024-01-01"} {
+		_, _, err = viewRange(httptest.NewRequest("GET", "/viewData/main?"+q, nil), now)
+		assert.Error(t, err, q)
+	}
+}
+
+func Test_FullData(t *testing.T) {
+	w := &Worker{data: historical{"t": secondly[int](config.History{}), "temp": minutely[int](config.History{})}}
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	w.data["temp"].Add(start, 50000)
+	w.data["temp"].Add(start.Add(time.Minute), 51000)
+	w.data["temp"].Add(start.Add(5*time.Minute), 52000) // missed samples are not made up
+	for i := 0; i < policyHistorySeconds+10; i++ {
+		w.data["t"].Add(start.Add(time.Duration(i)*time.Second), i)
+	}
+
+	data, err := json.Marshal(w.getFullData())
+	assert.NoError(t, err)
+	var out struct {
+		Data  map[string]struct{ Time []time.Time }
+		Dates []string
+	}
+	assert.NoError(t, json.Unmarshal(data, &out))
+	assert.Nil(t, out.Dates)
+	assert.Equal(t, []time.Time{start, start.Add(time.Minute), start.Add(5 * time.Minute)}, out.Data["temp"].Time)
+	assert.Len(t, out.Data["t"].Time, policyHistorySeconds)
+	assert.Equal(t, start.Add(time.Duration(policyHistorySeconds+9)*time.Second), out.Data["t"].Time[policyHistorySeconds-1])
 }
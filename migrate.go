@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/parMaster/rpid/config"
+	"github.com/parMaster/rpid/storage/sqlite"
+)
+
+// MigrateCmd shows and applies sqlite schema migrations. The service applies them at start too
+type MigrateCmd struct {
+	Status bool `long:"status" description:"show schema version and migrations, the default"`
+	Up     bool `long:"up" description:"back up the database and apply pending migrations"`
+	DryRun bool `long:"dry-run" description:"apply pending migrations and roll them back, nothing is changed"`
+}
+
+// Run migrates the configured database and prints the migrations state
+func (cmd *MigrateCmd) Run(ctx context.Context, conf *config.Parameters, out io.Writer) error {
+	if conf == nil || conf.Storage.Type != "sqlite" {
+		return fmt.Errorf("sqlite storage is not configured")
+	}
+	if cmd.Up && cmd.DryRun {
+		return fmt.Errorf("--up and --dry-run are exclusive")
+	}
+	path := conf.Storage.Path
+	if !cmd.Up && !cmd.DryRun {
+		path = "file:" + path + "?mode=ro" // status changes nothing
+	}
+	store, err := sqlite.NewStorage(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	if cmd.Up || cmd.DryRun {
+		applied, backup, err := store.Migrate(ctx, cmd.DryRun)
+		for _, m := range applied {
+			fmt.Fprintf(out, "applied %d: %s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case len(applied) == 0:
+			fmt.Fprintln(out, "schema is up to date")
+		case cmd.DryRun:
+			fmt.Fprintln(out, "dry run, rolled back")
+		case backup != "":
+			fmt.Fprintf(out, "backup: %s\n", backup)
+		}
+	}
+
+	version, states, err := store.Migrations(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "schema version %d\n", version)
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "version\tmigration\tapplied")
+	for _, st := range states {
+		applied := "pending"
+		if !st.Applied.IsZero() {
+			applied = st.Applied.Format(time.DateTime)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", st.Version, st.Name, applied)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/parMaster/rpid/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Migrate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "data.db")
+	db, err := sql.Open("sqlite3", path)
+	assert.NoError(t, err)
+	_, err = db.Exec("CREATE TABLE `main` (DateTime TEXT, Topic TEXT, Value TEXT); INSERT INTO `main` VALUES ('2022-03-30 00:00', 'temp', '36000')")
+	assert.NoError(t, err)
+	db.Close()
+	conf := &config.Parameters{Storage: config.Storage{Type: "sqlite", Path: path}}
+
+	out := &bytes.Buffer{}
+	assert.NoError(t, (&MigrateCmd{Status: true}).Run(ctx, conf, out))
+	assert.Contains(t, out.String(), "schema version 0")
+	assert.Contains(t, out.String(), "pending")
+
+	out.Reset()
+	assert.NoError(t, (&MigrateCmd{DryRun: true}).Run(ctx, conf, out))
+	assert.Contains(t, out.String(), "dry run, rolled back")
+	assert.Contains(t, out.String(), "schema version 0")
+	db, err = sql.Open("sqlite3", path)
+	assert.NoError(t, err)
+	var tables int
+	assert.NoError(t, db.QueryRow("SELECT COUNT(*) FROM sqlite_master").Scan(&tables))
+	assert.Equal(t, 1, tables, "status and dry run change nothing")
+	db.Close()
+
+	out.Reset()
+	assert.NoError(t, (&MigrateCmd{Up: true}).Run(ctx, conf, out))
+	assert.Contains(t, out.String(), "backup: "+path+".v0-")
+	assert.Contains(t, out.String(), "schema version 4")
+	assert.NotContains(t, out.String(), "pending")
+
+	out.Reset()
+	assert.NoError(t, (&MigrateCmd{Up: true}).Run(ctx, conf, out))
+	assert.Contains(t, out.String(), "schema is up to date")
+
+	assert.Error(t, (&MigrateCmd{Up: true, DryRun: true}).Run(ctx, conf, out))
+	assert.Error(t, (&MigrateCmd{}).Run(ctx, &config.Parameters{}, out))
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/parMaster/rpid/config"
 	"github.com/parMaster/rpid/storage"
@@ -19,7 +20,7 @@ const (
 )
 
 type Bmp280Reporter struct {
-	data         map[string][]ShortFloat
+	data         map[string]*Series[ShortFloat]
 	cfg          config.BMP280
 	bmp280Data   physic.Env
 	bmp280Device *bmxx80.Dev
@@ -28,14 +29,14 @@ type Bmp280Reporter struct {
 	store        storage.Storer
 }
 
-func LoadBmp280Reporter(cfg config.BMP280, i2cBus i2c.BusCloser, store storage.Storer) (*Bmp280Reporter, error) {
+func LoadBmp280Reporter(cfg config.BMP280, i2cBus i2c.BusCloser, store storage.Storer, history config.History) (*Bmp280Reporter, error) {
 	if !cfg.Enabled {
 		return nil, fmt.Errorf("Bmp280Reporter is not enabled")
 	}
 
-	data := map[string][]ShortFloat{
-		"pressure": {}, // Atmospheric pressure from BMP280 in hPa
-		"temp":     {}, // Temperature from BMP280 in mC
+	data := map[string]*Series[ShortFloat]{
+		"pressure": minutely[ShortFloat](history), // Atmospheric pressure from BMP280 in hPa
+		"temp":     minutely[ShortFloat](history), // Temperature from BMP280 in mC
 	}
 
 	bmp280Device, err := bmxx80.NewI2C(i2cBus, cfg.Bmp280Addr, &bmxx80.DefaultOpts)
@@ -61,15 +62,16 @@ func (r *Bmp280Reporter) Collect(ctx context.Context) error {
 	pressurePa := ShortFloat(r.bmp280Data.Pressure / physic.Pascal)
 	tempMilliC := ShortFloat(r.bmp280Data.Temperature-physic.ZeroCelsius) / 1000000000
 
+	now := time.Now()
 	r.mx.Lock()
-	r.data["pressure"] = append(r.data["pressure"], pressurePa/100)
-	r.data["temp"] = append(r.data["temp"], tempMilliC)
+	r.data["pressure"].Add(now, pressurePa/100)
+	r.data["temp"].Add(now, tempMilliC)
 	r.mx.Unlock()
 
 	log.Printf("[DEBUG] BMP280: %8s | %s hPa \n", r.bmp280Data.Temperature, pressurePa)
 
 	if r.store != nil {
-		err := r.store.Write(ctx, model.Data{Module: r.Name(), Topic: "pressure", Value: fmt.Sprint(pressurePa / 100)})
+		err := r.store.Write(ctx, model.Data{Module: r.Name(), Time: now, Topic: "pressure", Value: float64(pressurePa / 100), Unit: "hPa"})
 		if err != nil {
 			return fmt.Errorf("[ERROR] Bmp280Reporter: failed to write to storage: %v", err)
 		}
@@ -80,5 +82,26 @@ func (r *Bmp280Reporter) Collect(ctx context.Context) error {
 func (r *Bmp280Reporter) Report() (interface{}, error) {
 	r.mx.Lock()
 	defer r.mx.Unlock()
-	return r.data, nil
+	return cloneAll(r.data), nil
+}
+
+// Restore prefills pressure history, the only stored topic
+func (r *Bmp280Reporter) Restore(data []model.Data) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	for _, d := range data {
+		if d.Topic == "pressure" {
+			restorePoint(r.data["pressure"], d, toShortFloat)
+		}
+	}
+}
+
+func (r *Bmp280Reporter) Last(topic string) (float64, bool) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	s, ok := r.data[topic]
+	if !ok || s.Len() == 0 {
+		return 0, false
+	}
+	return float64(s.LastValue()), true
 }
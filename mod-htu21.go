@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/parMaster/htu21"
 	"github.com/parMaster/rpid/config"
@@ -21,13 +22,13 @@ type Htu21Reporter struct {
 	mx          sync.Mutex
 }
 
-func LoadHtu21Reporter(cfg config.HTU21, i2cBus i2c.BusCloser) (*Htu21Reporter, error) {
+func LoadHtu21Reporter(cfg config.HTU21, i2cBus i2c.BusCloser, history config.History) (*Htu21Reporter, error) {
 	if !cfg.Enabled {
 		return nil, fmt.Errorf("Htu21Reporter is not enabled")
 	}
 	data := historical{
-		"humidity": {}, // Humidity from HTU21 in mRh
-		"temp":     {}, // unused
+		"humidity": minutely[int](history), // Humidity from HTU21 in mRh
+		"temp":     minutely[int](history), // unused
 	}
 
 	htu21Device, err := htu21.NewI2C(i2cBus, cfg.Htu21Addr)
@@ -48,9 +49,10 @@ func (r *Htu21Reporter) Collect(context.Context) error {
 	humidMilliRH := r.htu21Data.Humidity / 10000
 	tempMilliC := int64(r.htu21Data.Temperature-physic.ZeroCelsius) / 1000000
 
+	now := time.Now()
 	r.mx.Lock()
-	r.data["humidity"] = append(r.data["humidity"], int(humidMilliRH))
-	r.data["temp"] = append(r.data["temp"], int(tempMilliC))
+	r.data["humidity"].Add(now, int(humidMilliRH))
+	r.data["temp"].Add(now, int(tempMilliC))
 	r.mx.Unlock()
 
 	log.Printf("[DEBUG] HTU21: %8s | %s (%d mRh) \n", r.htu21Data.Temperature, r.htu21Data.Humidity, humidMilliRH)
@@ -60,5 +62,15 @@ func (r *Htu21Reporter) Collect(context.Context) error {
 func (r *Htu21Reporter) Report() (interface{}, error) {
 	r.mx.Lock()
 	defer r.mx.Unlock()
-	return r.data, nil
+	return historical(cloneAll(r.data)), nil
+}
+
+func (r *Htu21Reporter) Last(topic string) (float64, bool) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	s, ok := r.data[topic]
+	if !ok || s.Len() == 0 {
+		return 0, false
+	}
+	return float64(s.LastValue()), true
 }
@@ -7,8 +7,10 @@ import (
 	"log"
 	"os"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/parMaster/rpid/config"
 	"github.com/parMaster/rpid/storage"
@@ -34,16 +36,17 @@ var Sensors = []string{
 
 type Smc768Data map[string]string
 
-type Smc768Response map[string][]string
+type Smc768Response map[string]*Series[string]
 
 type Smc768Reporter struct {
-	data  Smc768Response
-	dbg   bool
-	mx    sync.Mutex
-	store storage.Storer
+	data    Smc768Response
+	dbg     bool
+	mx      sync.Mutex
+	store   storage.Storer
+	history config.History // retention of the sensor series
 }
 
-func LoadSmc768Reporter(cfg config.Smc768, store storage.Storer, dbg bool) (*Smc768Reporter, error) {
+func LoadSmc768Reporter(cfg config.Smc768, store storage.Storer, dbg bool, history config.History) (*Smc768Reporter, error) {
 	if !cfg.Enabled {
 		return nil, fmt.Errorf("Smc768Reporter is not enabled")
 	}
@@ -53,9 +56,10 @@ func LoadSmc768Reporter(cfg config.Smc768, store storage.Storer, dbg bool) (*Smc
 	}
 
 	return &Smc768Reporter{
-		dbg:   dbg,
-		store: store,
-		data:  make(Smc768Response),
+		dbg:     dbg,
+		store:   store,
+		history: history,
+		data:    make(Smc768Response),
 	}, nil
 }
 
@@ -74,7 +78,11 @@ func (r *Smc768Reporter) Collect(ctx context.Context) (err error) {
 
 	if r.store != nil {
 		for _, label := range Sensors {
-			err := r.store.Write(ctx, model.Data{Module: r.Name(), Topic: label, Value: data[label]})
+			v, perr := strconv.ParseFloat(data[label], 64)
+			if perr != nil {
+				continue // sensor isn't read
+			}
+			err := r.store.Write(ctx, model.Data{Module: r.Name(), Topic: label, Value: v})
 			if err != nil {
 				return errors.Join(err, fmt.Errorf("failed to write to storage: %v", err))
 			}
@@ -86,12 +94,44 @@ func (r *Smc768Reporter) Collect(ctx context.Context) (err error) {
 func (r *Smc768Reporter) Report() (interface{}, error) {
 	r.mx.Lock()
 	defer r.mx.Unlock()
-	return r.data, nil
+	return Smc768Response(cloneAll(r.data)), nil
+}
+
+func (r *Smc768Reporter) Last(topic string) (float64, bool) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	s, ok := r.data[topic]
+	if !ok || s.Len() == 0 {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(s.LastValue(), 64)
+	return v, err == nil
+}
+
+// Restore prefills sensor history with the stored sensor topics
+func (r *Smc768Reporter) Restore(data []model.Data) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	for _, d := range data {
+		if r.data[d.Topic] == nil {
+			r.data[d.Topic] = minutely[string](r.history)
+		}
+		restorePoint(r.data[d.Topic], d, toString)
+	}
+}
+
+// add appends the sensor value to its series
+func (r *Smc768Reporter) add(now time.Time, label, value string) {
+	if r.data[label] == nil {
+		r.data[label] = minutely[string](r.history)
+	}
+	r.data[label].Add(now, value)
 }
 
 func (r *Smc768Reporter) ReadSMC768() Smc768Data {
 
 	data := make(Smc768Data)
+	now := time.Now()
 
 	// Read the data from the SMC768 and store it in the data map
 	for i := 1; i <= 60; i++ {
@@ -99,14 +139,14 @@ func (r *Smc768Reporter) ReadSMC768() Smc768Data {
 		label := ReadInput(fmt.Sprintf("/sys/devices/platform/applesmc.768/temp%d_label", i))
 		if slices.Contains(Sensors, label) {
 			data[label] = value
-			r.data[label] = append(r.data[label], value)
+			r.add(now, label, value)
 		}
 	}
 
 	data["Exhaust"] = ReadInput("/sys/devices/platform/applesmc.768/fan1_input")
-	r.data["Exhaust"] = append(r.data["Exhaust"], data["Exhaust"])
+	r.add(now, "Exhaust", data["Exhaust"])
 	data["ThrottleTime"] = ReadInput("/sys/devices/system/cpu/cpu0/thermal_throttle/core_throttle_total_time_ms")
-	r.data["ThrottleTime"] = append(r.data["ThrottleTime"], data["ThrottleTime"])
+	r.add(now, "ThrottleTime", data["ThrottleTime"])
 
 	if r.dbg {
 		log.Printf("[DEBUG] Smc768Reporter: data:")
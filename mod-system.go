@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/parMaster/rpid/config"
 	"github.com/parMaster/rpid/storage"
@@ -28,7 +29,7 @@ func (f ShortFloat) String() string {
 
 type Response struct {
 	TimeInState map[string]int
-	LoadAvg     map[string][]ShortFloat
+	LoadAvg     map[string]*Series[ShortFloat]
 }
 
 type SystemReporter struct {
@@ -38,7 +39,7 @@ type SystemReporter struct {
 	store storage.Storer
 }
 
-func LoadSystemReporter(cfg config.System, store storage.Storer, dbg bool) (*SystemReporter, error) {
+func LoadSystemReporter(cfg config.System, store storage.Storer, dbg bool, history config.History) (*SystemReporter, error) {
 	if !cfg.Enabled {
 		return nil, fmt.Errorf("SystemReporter is not enabled")
 	}
@@ -52,7 +53,11 @@ func LoadSystemReporter(cfg config.System, store storage.Storer, dbg bool) (*Sys
 		store: store,
 		data: Response{
 			TimeInState: map[string]int{},
-			LoadAvg:     map[string][]ShortFloat{},
+			LoadAvg: map[string]*Series[ShortFloat]{
+				"1m":  minutely[ShortFloat](history),
+				"5m":  minutely[ShortFloat](history),
+				"15m": minutely[ShortFloat](history),
+			},
 		},
 	}, nil
 }
@@ -74,12 +79,13 @@ func (r *SystemReporter) Collect(ctx context.Context) (err error) {
 	if err != nil {
 		return errors.Join(err, fmt.Errorf("failed to get load avg: %v", err))
 	} else {
-		r.data.LoadAvg["1m"] = append(r.data.LoadAvg["1m"], la["1m"])
-		r.data.LoadAvg["5m"] = append(r.data.LoadAvg["5m"], la["5m"])
-		r.data.LoadAvg["15m"] = append(r.data.LoadAvg["15m"], la["15m"])
+		now := time.Now()
+		for _, k := range []string{"1m", "5m", "15m"} {
+			r.data.LoadAvg[k].Add(now, la[k])
+		}
 
 		if r.store != nil {
-			err := r.store.Write(ctx, model.Data{Module: r.Name(), Topic: "la5m", Value: la["5m"].String()})
+			err := r.store.Write(ctx, model.Data{Module: r.Name(), Time: now, Topic: "la5m", Value: float64(la["5m"])})
 			if err != nil {
 				return errors.Join(err, fmt.Errorf("failed to write to storage: %v", err))
 			}
@@ -88,10 +94,32 @@ func (r *SystemReporter) Collect(ctx context.Context) (err error) {
 	return err
 }
 
+// Restore prefills 5m load average history, the only stored topic
+func (r *SystemReporter) Restore(data []model.Data) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	for _, d := range data {
+		if d.Topic == "la5m" {
+			restorePoint(r.data.LoadAvg["5m"], d, toShortFloat)
+		}
+	}
+}
+
 func (r *SystemReporter) Report() (interface{}, error) {
 	r.mx.Lock()
 	defer r.mx.Unlock()
-	return r.data, nil
+	return Response{TimeInState: r.data.TimeInState, LoadAvg: cloneAll(r.data.LoadAvg)}, nil
+}
+
+// Last returns the latest load average, topics are la1m, la5m and la15m
+func (r *SystemReporter) Last(topic string) (float64, bool) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	la, ok := r.data.LoadAvg[strings.TrimPrefix(topic, "la")]
+	if !ok || la.Len() == 0 {
+		return 0, false
+	}
+	return float64(la.LastValue()), true
 }
 
 func (r *SystemReporter) getCPUTimeInState(dbg bool) (map[string]int, error) {
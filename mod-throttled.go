@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/parMaster/rpid/config"
+	"github.com/parMaster/rpid/storage"
+	"github.com/parMaster/rpid/storage/model"
+)
+
+// firmware get_throttled, same value vcgencmd get_throttled reports
+const throttledSysfs = "/sys/devices/platform/soc/soc:firmware/get_throttled"
+
+// how many flag transitions the module keeps in memory
+const throttledEventsLimit = 100
+
+// throttled bits, current state. Since boot ones are 16 bits higher
+// https://www.raspberrypi.com/documentation/computers/os.html#get_throttled
+var throttledFlags = []struct {
+	topic string
+	bit   uint
+}{
+	{"undervoltage", 0},
+	{"freq_capped", 1},
+	{"throttled", 2},
+	{"soft_temp_limit", 3},
+}
+
+const throttledSinceBootShift = 16
+
+// ThrottledEvent is the transition of one of the flags
+type ThrottledEvent struct {
+	Time  time.Time
+	Topic string
+	On    bool
+}
+
+type ThrottledResponse struct {
+	Raw       string           // bitmask as reported by firmware, like 0x50005
+	Now       map[string]bool  // flags set at the moment
+	SinceBoot map[string]bool  // flags set at any time since boot
+	History   historical       // 0 or 1 by minute, current flags
+	Events    []ThrottledEvent // recent transitions, oldest first
+}
+
+// ThrottledReporter decodes Raspberry Pi firmware undervoltage and throttling flags
+type ThrottledReporter struct {
+	cfg   config.Throttled
+	data  ThrottledResponse
+	dbg   bool
+	mx    sync.Mutex
+	store storage.Storer
+	read  func() (string, error) // returns firmware bitmask, in any get_throttled format
+	known bool                   // flags were read at least once
+	value uint32                 // latest bitmask
+	// retention of the flag series
+	history config.History
+}
+
+func LoadThrottledReporter(cfg config.Throttled, store storage.Storer, dbg bool, history config.History) (*ThrottledReporter, error) {
+	if !cfg.Enabled {
+		return nil, fmt.Errorf("ThrottledReporter is not enabled")
+	}
+
+	if store != nil {
+		log.Printf("[DEBUG] ThrottledReporter: using storage (%T)", store)
+	}
+
+	r := &ThrottledReporter{
+		cfg:     cfg,
+		dbg:     dbg,
+		store:   store,
+		history: history,
+		data: ThrottledResponse{
+			Now:       map[string]bool{},
+			SinceBoot: map[string]bool{},
+			History:   historical{},
+		},
+	}
+	r.read = r.readThrottled
+	return r, nil
+}
+
+func (r *ThrottledReporter) Name() string {
+	return "throttled"
+}
+
+func (r *ThrottledReporter) Collect(ctx context.Context) (err error) {
+	raw, err := r.read()
+	if err != nil {
+		return errors.Join(err, errors.New("failed to get throttled flags"))
+	}
+	value, err := parseThrottled(raw)
+	if err != nil {
+		return err
+	}
+	return r.update(ctx, time.Now(), value)
+}
+
+// update records the flags and their transitions
+func (r *ThrottledReporter) update(ctx context.Context, now time.Time, value uint32) (err error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	r.data.Raw = fmt.Sprintf("0x%x", value)
+	var events []ThrottledEvent
+	for _, f := range throttledFlags {
+		on := value&(1<<f.bit) != 0
+		r.data.Now[f.topic] = on
+		r.data.SinceBoot[f.topic] = value&(1<<(f.bit+throttledSinceBootShift)) != 0
+		if r.data.History[f.topic] == nil {
+			r.data.History[f.topic] = minutely[int](r.history)
+		}
+		r.data.History[f.topic].Add(now, boolInt(on))
+
+		// flags set at start are events too, cleared ones are not
+		if was := r.value&(1<<f.bit) != 0; on != was {
+			events = append(events, ThrottledEvent{Time: now, Topic: f.topic, On: on})
+		}
+	}
+	r.known, r.value = true, value
+
+	for _, e := range events {
+		state := "cleared"
+		if e.On {
+			state = "set"
+		}
+		log.Printf("[WARN] Throttled: %s %s (0x%x)", e.Topic, state, value)
+	}
+	r.data.Events = append(r.data.Events, events...)
+	if len(r.data.Events) > throttledEventsLimit {
+		r.data.Events = r.data.Events[len(r.data.Events)-throttledEventsLimit:]
+	}
+
+	if r.store == nil {
+		return nil
+	}
+	for _, f := range throttledFlags {
+		for topic, on := range map[string]bool{f.topic: r.data.Now[f.topic], f.topic + "_occurred": r.data.SinceBoot[f.topic]} {
+			if werr := r.store.Write(ctx, model.Data{Module: r.Name(), Time: now, Topic: topic, Value: float64(boolInt(on))}); werr != nil {
+				err = errors.Join(err, fmt.Errorf("failed to write to storage: %v", werr))
+			}
+		}
+	}
+	for _, e := range events {
+		value := e.Topic + " cleared"
+		if e.On {
+			value = e.Topic + " set"
+		}
+		if werr := r.store.Write(ctx, model.Data{Module: r.Name(), Time: e.Time, Topic: "event", Text: value}); werr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to write to storage: %v", werr))
+		}
+	}
+	return err
+}
+
+// Restore prefills flag history and recent events. Current flags are unknown until they are read
+func (r *ThrottledReporter) Restore(data []model.Data) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	for _, d := range data {
+		if d.Topic == "event" {
+			if topic, state, ok := strings.Cut(d.Text, " "); ok {
+				r.data.Events = append(r.data.Events, ThrottledEvent{Time: d.Time, Topic: topic, On: state == "set"})
+			}
+			continue
+		}
+		for _, f := range throttledFlags {
+			if f.topic != d.Topic {
+				continue
+			}
+			if r.data.History[f.topic] == nil {
+				r.data.History[f.topic] = minutely[int](r.history)
+			}
+			restorePoint(r.data.History[f.topic], d, toInt)
+		}
+	}
+	if len(r.data.Events) > throttledEventsLimit {
+		r.data.Events = r.data.Events[len(r.data.Events)-throttledEventsLimit:]
+	}
+}
+
+func (r *ThrottledReporter) Report() (interface{}, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	out := r.data
+	out.Now, out.SinceBoot = maps.Clone(r.data.Now), maps.Clone(r.data.SinceBoot)
+	out.History = cloneAll(r.data.History)
+	out.Events = append([]ThrottledEvent{}, r.data.Events...)
+	return out, nil
+}
+
+// Last returns 1 if the flag is set, 0 otherwise. Topics are undervoltage, freq_capped, throttled
+// and soft_temp_limit, with _occurred suffix for the flags since boot
+func (r *ThrottledReporter) Last(topic string) (float64, bool) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if !r.known {
+		return 0, false
+	}
+	flags := r.data.Now
+	name, found := strings.CutSuffix(topic, "_occurred")
+	if found {
+		flags = r.data.SinceBoot
+	}
+	on, ok := flags[name]
+	return float64(boolInt(on)), ok
+}
+
+// readThrottled reads the bitmask from sysfs, vcgencmd or the sample file in debug mode
+func (r *ThrottledReporter) readThrottled() (string, error) {
+	if r.dbg {
+		data, err := os.ReadFile("data/get_throttled.txt")
+		return string(data), err
+	}
+	if r.cfg.Vcgencmd {
+		out, err := exec.Command("vcgencmd", "get_throttled").Output()
+		return string(out), err
+	}
+	data, err := os.ReadFile(throttledSysfs)
+	return string(data), err
+}
+
+// parseThrottled parses get_throttled value: "throttled=0x50005" from vcgencmd, "50005" from sysfs
+func parseThrottled(s string) (uint32, error) {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, "throttled=")
+	s = strings.TrimPrefix(s, "0x")
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected get_throttled value %q: %w", s, err)
+	}
+	return uint32(v), nil
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/parMaster/rpid/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParseThrottled(t *testing.T) {
+	for in, want := range map[string]uint32{"throttled=0x50005\n": 0x50005, "50000\n": 0x50000, "0x0": 0} {
+		v, err := parseThrottled(in)
+		assert.NoError(t, err, in)
+		assert.Equal(t, want, v, in)
+	}
+	_, err := parseThrottled("throttled=none")
+	assert.Error(t, err)
+}
+
+func Test_ThrottledReporter(t *testing.T) {
+	_, err := LoadThrottledReporter(config.Throttled{}, nil, true, config.History{})
+	assert.Error(t, err)
+
+	r, err := LoadThrottledReporter(config.Throttled{Enabled: true}, nil, true, config.History{})
+	assert.NoError(t, err)
+	_, ok := r.Last("undervoltage")
+	assert.False(t, ok)
+
+	// sample file: undervoltage and throttled now and since boot
+	ctx := context.Background()
+	assert.NoError(t, r.Collect(ctx))
+	v, ok := r.Last("undervoltage")
+	assert.True(t, ok)
+	assert.Equal(t, 1.0, v)
+	v, _ = r.Last("freq_capped")
+	assert.Equal(t, 0.0, v)
+	v, _ = r.Last("throttled_occurred")
+	assert.Equal(t, 1.0, v)
+
+	now := time.Now()
+	assert.NoError(t, r.update(ctx, now, 0x50005)) // no change
+	assert.NoError(t, r.update(ctx, now, 0x50000)) // recovered, since boot flags stay
+
+	data, _ := r.Report()
+	resp := data.(ThrottledResponse)
+	assert.Equal(t, "0x50000", resp.Raw)
+	assert.False(t, resp.Now["undervoltage"])
+	assert.True(t, resp.SinceBoot["undervoltage"])
+	assert.False(t, resp.SinceBoot["freq_capped"])
+	assert.Equal(t, []int{1, 1, 0}, resp.History["throttled"].Values())
+
+	var events []string
+	for _, e := range resp.Events {
+		state := "cleared"
+		if e.On {
+			state = "set"
+		}
+		events = append(events, e.Topic+" "+state)
+	}
+	assert.Equal(t, []string{"undervoltage set", "throttled set", "undervoltage cleared", "throttled cleared"}, events)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/parMaster/rpid/config"
+	"github.com/parMaster/rpid/storage"
+	"github.com/parMaster/rpid/storage/model"
+)
+
+// ZonesResponse is the zones module report
+type ZonesResponse struct {
+	Zones []ThermalZone
+	Temp  historical // m˚C by zone name
+}
+
+// ZonesReporter records temperatures of all kernel thermal zones, each zone is its own topic
+type ZonesReporter struct {
+	sysfs   string
+	data    ZonesResponse
+	mx      sync.Mutex
+	store   storage.Storer
+	history config.History // retention of the zone series
+}
+
+func LoadZonesReporter(cfg config.ThermalZones, sysfs string, store storage.Storer, history config.History) (*ZonesReporter, error) {
+	if !cfg.Enabled {
+		return nil, fmt.Errorf("ZonesReporter is not enabled")
+	}
+
+	zones, err := readThermalZones(sysfs)
+	if err != nil {
+		return nil, fmt.Errorf("can't read thermal zones: %w", err)
+	}
+	if len(zones) == 0 {
+		return nil, fmt.Errorf("no thermal zones found in %s", sysfs)
+	}
+	for _, z := range zones {
+		log.Printf("[INFO] Thermal zone %s: %s, trip points %v", z.Name, z.Type, z.Trips)
+	}
+
+	return &ZonesReporter{
+		sysfs:   sysfs,
+		store:   store,
+		history: history,
+		data:    ZonesResponse{Zones: zones, Temp: historical{}},
+	}, nil
+}
+
+func (r *ZonesReporter) Name() string {
+	return "zones"
+}
+
+func (r *ZonesReporter) Collect(ctx context.Context) (err error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	now := time.Now()
+	for _, z := range r.data.Zones {
+		temp, zerr := readThermalZone(r.sysfs, z.Name)
+		if zerr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to read %s: %w", z.Name, zerr))
+			continue
+		}
+		if r.data.Temp[z.Name] == nil {
+			r.data.Temp[z.Name] = minutely[int](r.history)
+		}
+		r.data.Temp[z.Name].Add(now, temp)
+
+		if r.store != nil {
+			if werr := r.store.Write(ctx, model.Data{Module: r.Name(), Time: now, Topic: z.Name, Value: float64(temp), Unit: "m˚C"}); werr != nil {
+				err = errors.Join(err, fmt.Errorf("failed to write to storage: %w", werr))
+			}
+		}
+	}
+	return err
+}
+
+func (r *ZonesReporter) Report() (interface{}, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return ZonesResponse{Zones: r.data.Zones, Temp: cloneAll(r.data.Temp)}, nil
+}
+
+// Restore prefills temperature history of the zones found at start
+func (r *ZonesReporter) Restore(data []model.Data) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	for _, d := range data {
+		for _, z := range r.data.Zones {
+			if z.Name != d.Topic {
+				continue
+			}
+			if r.data.Temp[z.Name] == nil {
+				r.data.Temp[z.Name] = minutely[int](r.history)
+			}
+			restorePoint(r.data.Temp[z.Name], d, toInt)
+		}
+	}
+}
+
+// Last returns the latest temperature of the zone, m˚C. Topic is the zone name, like thermal_zone1
+func (r *ZonesReporter) Last(topic string) (float64, bool) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	s, ok := r.data.Temp[topic]
+	if !ok || s.Len() == 0 {
+		return 0, false
+	}
+	return float64(s.LastValue()), true
+}
@@ -1,6 +1,11 @@
 package main
 
-import "context"
+import (
+	"context"
+	"fmt"
+
+	"github.com/parMaster/rpid/storage/model"
+)
 
 type CollectReporter interface {
 	Name() string
@@ -8,6 +13,16 @@ type CollectReporter interface {
 	Report() (interface{}, error)
 }
 
+// TopicReader is implemented by modules which can tell the latest value of a topic
+type TopicReader interface {
+	Last(topic string) (float64, bool)
+}
+
+// Restorer is implemented by modules which prefill their history with stored data at start
+type Restorer interface {
+	Restore(data []model.Data)
+}
+
 type Modules []CollectReporter
 
 func (m Modules) String() string {
@@ -26,3 +41,22 @@ func (m Modules) Loaded(name string) bool {
 	}
 	return false
 }
+
+// Last returns the latest value of the module topic
+func (m Modules) Last(module, topic string) (float64, error) {
+	for _, mod := range m {
+		if mod.Name() != module {
+			continue
+		}
+		r, ok := mod.(TopicReader)
+		if !ok {
+			return 0, fmt.Errorf("module %s doesn't report topics", module)
+		}
+		v, ok := r.Last(topic)
+		if !ok {
+			return 0, fmt.Errorf("no %s/%s data yet", module, topic)
+		}
+		return v, nil
+	}
+	return 0, fmt.Errorf("module %s is not loaded", module)
+}
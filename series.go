@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/parMaster/rpid/config"
+)
+
+// Point is the timestamped sample
+type Point[T any] struct {
+	Time  time.Time
+	Value T
+}
+
+// Series is the bounded time series: a ring buffer, oldest samples are overwritten once it's full.
+// Not safe for concurrent use, owners guard it with their own locks
+type Series[T any] struct {
+	points []Point[T]
+	start  int // index of the oldest point, once the buffer is full
+	size   int // capacity, retention / resolution
+}
+
+// NewSeries creates the series keeping samples taken every resolution for the retention time
+func NewSeries[T any](resolution, keep time.Duration) *Series[T] {
+	return &Series[T]{size: max(1, int(keep/resolution))}
+}
+
+// secondly creates the series of samples taken every second, kept for the seconds retention
+func secondly[T any](h config.History) *Series[T] {
+	return NewSeries[T](time.Second, h.WithDefaults().Seconds)
+}
+
+// minutely creates the series of samples aggregated by minute, kept for the minutes retention
+func minutely[T any](h config.History) *Series[T] {
+	return NewSeries[T](time.Minute, h.WithDefaults().Minutes)
+}
+
+// Add appends the sample, dropping the oldest one if the series is full
+func (s *Series[T]) Add(t time.Time, v T) {
+	if len(s.points) < s.size {
+		s.points = append(s.points, Point[T]{t, v})
+		return
+	}
+	s.points[s.start] = Point[T]{t, v}
+	s.start = (s.start + 1) % s.size
+}
+
+// Len returns the number of samples
+func (s *Series[T]) Len() int {
+	return len(s.points)
+}
+
+// Last returns the latest sample, zero value if there is none
+func (s *Series[T]) Last() (p Point[T], ok bool) {
+	if len(s.points) == 0 {
+		return p, false
+	}
+	return s.points[(s.start+len(s.points)-1)%len(s.points)], true
+}
+
+// LastValue returns the latest value, zero if there is none
+func (s *Series[T]) LastValue() T {
+	p, _ := s.Last()
+	return p.Value
+}
+
+// Points returns all samples, oldest first
+func (s *Series[T]) Points() []Point[T] {
+	out := make([]Point[T], 0, len(s.points))
+	out = append(out, s.points[s.start:]...)
+	return append(out, s.points[:s.start]...)
+}
+
+// Values returns all values, oldest first
+func (s *Series[T]) Values() []T {
+	return s.Tail(len(s.points))
+}
+
+// Tail returns up to n latest values, oldest first
+func (s *Series[T]) Tail(n int) []T {
+	n = min(n, len(s.points))
+	out := make([]T, n)
+	for i := range out {
+		out[i] = s.points[(s.start+len(s.points)-n+i)%len(s.points)].Value
+	}
+	return out
+}
+
+// Window returns the values sampled within d before the latest one, oldest first.
+// The latest one is included, the one sampled exactly d before it is not
+func (s *Series[T]) Window(d time.Duration) []T {
+	p, ok := s.Last()
+	if !ok {
+		return []T{}
+	}
+	return s.Since(p.Time.Add(-d))
+}
+
+// Since returns the values sampled after t, oldest first
+func (s *Series[T]) Since(t time.Time) []T {
+	n := 0
+	for i := len(s.points) - 1; i >= 0; i-- {
+		if !s.points[(s.start+i)%len(s.points)].Time.After(t) {
+			break
+		}
+		n++
+	}
+	return s.Tail(n)
+}
+
+// MarshalJSON encodes sample times and values as two arrays, oldest first
+func (s *Series[T]) MarshalJSON() ([]byte, error) {
+	out := struct {
+		Time  []time.Time
+		Value []T
+	}{make([]time.Time, 0, len(s.points)), make([]T, 0, len(s.points))}
+	for _, p := range s.Points() {
+		out.Time = append(out.Time, p.Time)
+		out.Value = append(out.Value, p.Value)
+	}
+	return json.Marshal(out)
+}
+
+// Clone returns the copy of the series
+func (s *Series[T]) Clone() *Series[T] {
+	c := *s
+	c.points = append([]Point[T]{}, s.points...)
+	return &c
+}
+
+// Latest returns the copy of the series with up to n latest samples
+func (s *Series[T]) Latest(n int) *Series[T] {
+	points := s.Points()
+	return &Series[T]{points: points[len(points)-min(n, len(points)):], size: s.size}
+}
+
+// cloneAll copies the series by topic, for reports encoded outside of the owner's lock
+func cloneAll[T any](m map[string]*Series[T]) map[string]*Series[T] {
+	out := make(map[string]*Series[T], len(m))
+	for k, s := range m {
+		out[k] = s.Clone()
+	}
+	return out
+}
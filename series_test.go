@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/parMaster/rpid/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Series(t *testing.T) {
+	s := NewSeries[int](time.Second, 5*time.Second)
+	_, ok := s.Last()
+	assert.False(t, ok)
+	assert.Equal(t, 0, s.LastValue())
+	assert.Empty(t, s.Window(time.Minute))
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 1; i <= 3; i++ {
+		s.Add(start.Add(time.Duration(i)*time.Second), i)
+	}
+	assert.Equal(t, []int{1, 2, 3}, s.Values())
+	assert.Equal(t, []int{2, 3}, s.Tail(2))
+	assert.Equal(t, []int{1, 2, 3}, s.Tail(10))
+
+	// oldest samples are overwritten once retention is reached
+	for i := 4; i <= 8; i++ {
+		s.Add(start.Add(time.Duration(i)*time.Second), i)
+	}
+	assert.Equal(t, 5, s.Len())
+	assert.Equal(t, []int{4, 5, 6, 7, 8}, s.Values())
+	p, ok := s.Last()
+	assert.True(t, ok)
+	assert.Equal(t, Point[int]{start.Add(8 * time.Second), 8}, p)
+	assert.Equal(t, start.Add(4*time.Second), s.Points()[0].Time)
+
+	assert.Equal(t, []int{7, 8}, s.Window(2*time.Second), "sample 2s before the latest one is out")
+	assert.Equal(t, []int{6, 7, 8}, s.Since(start.Add(5*time.Second)))
+
+	c := s.Clone()
+	s.Add(start.Add(9*time.Second), 9)
+	assert.Equal(t, []int{4, 5, 6, 7, 8}, c.Values())
+
+	l := s.Latest(2)
+	assert.Equal(t, []int{8, 9}, l.Values())
+	l.Add(start.Add(10*time.Second), 10)
+	assert.Equal(t, []int{5, 6, 7, 8, 9}, s.Values())
+
+	data, err := json.Marshal(map[string]*Series[int]{"t": s.Latest(2)})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"t":{"Time":["2024-01-01T00:00:08Z","2024-01-01T00:00:09Z"],"Value":[8,9]}}`, string(data))
+}
+
+func Test_SeriesRetention(t *testing.T) {
+	h := config.History{Seconds: 30 * time.Minute}
+	assert.Equal(t, 1800, secondly[int](h).size)
+	assert.Equal(t, 7*24*60, minutely[int](h).size, "unset retention is defaulted")
+}
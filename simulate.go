@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/parMaster/rpid/config"
+	"github.com/parMaster/rpid/storage/sqlite"
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/physic"
+)
+
+// SimulateCmd runs fan policies offline, against the thermal model or a recorded temperature trace
+type SimulateCmd struct {
+	Fan      string        `long:"fan" description:"fan name to take parameters from, fan section by default"`
+	Policies []string      `long:"policy" description:"policy to simulate, can be repeated. All policies by default"`
+	Trace    string        `long:"trace" description:"temperature trace, CSV (datetime,m˚C) or sqlite database"`
+	Duration time.Duration `long:"duration" default:"6h" description:"simulated time for the thermal model"`
+	Ambient  float64       `long:"ambient" default:"25" description:"thermal model: ambient temperature ˚C"`
+	Heat     float64       `long:"heat" default:"40" description:"thermal model: ˚C above ambient CPU settles at with the fan off"`
+	Cooling  float64       `long:"cooling" default:"0.5" description:"thermal model: share of heat the fan removes at full speed"`
+	Tau      time.Duration `long:"tau" default:"2m" description:"thermal model: time constant"`
+	Dbg      bool          `long:"dbg" description:"show fan control logs"`
+}
+
+// SimResult is the policy performance over the simulated time
+type SimResult struct {
+	Policy      string
+	AboveHigh   time.Duration // time input temperature was above High, zero when High is unset
+	Switches    int           // fan duty changes
+	DutyRuntime time.Duration // time at full speed the fan effort equals to
+	Peak        float64       // ˚C
+}
+
+// thermalModel is the first order CPU temperature model:
+// temperature approaches the steady state one, which the fan lowers
+type thermalModel struct {
+	ambient float64
+	heat    float64
+	cooling float64
+	tau     time.Duration
+	temp    float64
+}
+
+// Step advances the model by dt at the given duty, returns new temperature ˚C
+func (m *thermalModel) Step(dt time.Duration, duty int) float64 {
+	steady := m.ambient + m.heat*(1-m.cooling*float64(duty)/100)
+	m.temp += (steady - m.temp) * dt.Seconds() / m.tau.Seconds()
+	return m.temp
+}
+
+// traceSample is the recorded temperature, m˚C
+type traceSample struct {
+	at   time.Time
+	temp int
+}
+
+// virtualPin is the GPIO pin the simulated fan is connected to
+type virtualPin struct {
+	gpio.PinIO
+	level gpio.Level
+	duty  gpio.Duty
+}
+
+func (p *virtualPin) Out(l gpio.Level) error {
+	p.level = l
+	return nil
+}
+
+func (p *virtualPin) PWM(d gpio.Duty, f physic.Frequency) error {
+	p.duty = d
+	return nil
+}
+
+func (p *virtualPin) Halt() error { return nil }
+
+func (p *virtualPin) String() string { return "virtual" }
+
+// Run simulates every requested policy and prints the comparison
+func (cmd *SimulateCmd) Run(conf *config.Parameters, out io.Writer) error {
+	if conf == nil {
+		return fmt.Errorf("config is required")
+	}
+	var fan *config.Fan
+	for _, f := range conf.FanList() {
+		if f.Name == cmd.Fan {
+			f := f
+			fan = &f
+			break
+		}
+	}
+	if fan == nil {
+		return fmt.Errorf("fan %q is not configured", cmd.Fan)
+	}
+
+	var trace []traceSample
+	if cmd.Trace != "" {
+		var err error
+		if trace, err = loadTrace(cmd.Trace); err != nil {
+			return err
+		}
+		if len(trace) < 2 {
+			return fmt.Errorf("trace %s has less than two samples", cmd.Trace)
+		}
+	}
+
+	if !cmd.Dbg {
+		log.SetOutput(io.Discard)
+		defer log.SetOutput(os.Stderr)
+	}
+
+	policies := cmd.Policies
+	if len(policies) == 0 {
+		policies = []string{"hysteresis", "pid", "curve"}
+	}
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "policy\tabove high\tswitches\tduty runtime\tpeak ˚C")
+	for _, name := range policies {
+		cfg := *fan
+		cfg.Policy = name
+		if name == "pid" && cfg.PID.Setpoint == 0 {
+			cfg.PID.Setpoint = cfg.High
+		}
+		res, err := cmd.simulate(cfg, trace)
+		if err != nil {
+			fmt.Fprintf(tw, "%s\t%v\n", name, err)
+			continue
+		}
+		aboveHigh := "-"
+		if cfg.High > 0 {
+			aboveHigh = res.AboveHigh.String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%.1f\n", res.Policy, aboveHigh, res.Switches, res.DutyRuntime, res.Peak)
+	}
+	return tw.Flush()
+}
+
+// simulate runs the fan controller with virtual clock and pin, second by second.
+// Recorded trace is replayed as is, the fan doesn't affect it
+func (cmd *SimulateCmd) simulate(cfg config.Fan, trace []traceSample) (SimResult, error) {
+	policy, err := NewFanPolicy(cfg)
+	if err != nil {
+		return SimResult{}, err
+	}
+	if cfg.Mode == "cooling" {
+		cfg.Mode = "pwm" // cooling device states are duty steps, close enough to PWM
+	}
+	actuator, err := NewFanActuator(&virtualPin{PinIO: gpio.INVALID}, cfg)
+	if err != nil {
+		return SimResult{}, err
+	}
+	if f, ok := actuator.(*pwmFan); ok {
+		f.kickTime = 0 // no real time to wait in simulation
+	}
+
+	model := &thermalModel{ambient: cmd.Ambient, heat: cmd.Heat, cooling: cmd.Cooling, tau: cmd.Tau, temp: cmd.Ambient}
+	start, duration := time.Date(2000, 1, 1, 0, 0, 0, 0, time.Local), cmd.Duration
+	if trace != nil {
+		start, duration = trace[0].at, trace[len(trace)-1].at.Sub(trace[0].at)
+	}
+
+	temp := 0.0 // ˚C
+	c := &FanController{
+		cfg:    cfg,
+		input:  func() (int, error) { return int(temp * 1000), nil },
+		fan:    actuator,
+		policy: policy,
+		data:   historical{"t": secondly[int](config.History{}), "temp": minutely[int](config.History{}), "duty": minutely[int](config.History{})},
+	}
+	for _, p := range cfg.Profiles {
+		fp, err := newFanProfile(cfg, p)
+		if err != nil {
+			return SimResult{}, err
+		}
+		c.profiles = append(c.profiles, fp)
+	}
+
+	ctx := context.Background()
+	res := SimResult{Policy: policy.Name()}
+	period := int(policy.Period().Seconds())
+	for s := 0; time.Duration(s)*time.Second <= duration; s++ {
+		now := start.Add(time.Duration(s) * time.Second)
+		if trace != nil {
+			temp = float64(traceAt(trace, now)) / 1000
+		} else {
+			temp = model.Step(time.Second, c.Duty())
+		}
+
+		c.sample(ctx, now)
+		if s > 0 && s%60 == 0 {
+			c.aggregate(ctx, now)
+		}
+		if s > 0 && s%period == 0 {
+			duty := c.Duty()
+			c.step(ctx, now)
+			if c.Duty() != duty {
+				res.Switches++
+			}
+		}
+
+		if cfg.High > 0 && temp > float64(cfg.High) {
+			res.AboveHigh += time.Second
+		}
+		res.DutyRuntime += time.Second * time.Duration(c.Duty()) / 100
+		if temp > res.Peak {
+			res.Peak = temp
+		}
+	}
+	return res, nil
+}
+
+// traceAt interpolates the trace temperature at the given time
+func traceAt(trace []traceSample, at time.Time) int {
+	i := sort.Search(len(trace), func(i int) bool { return !trace[i].at.Before(at) })
+	switch {
+	case i == 0:
+		return trace[0].temp
+	case i == len(trace):
+		return trace[len(trace)-1].temp
+	}
+	a, b := trace[i-1], trace[i]
+	k := float64(at.Sub(a.at)) / float64(b.at.Sub(a.at))
+	return a.temp + int(k*float64(b.temp-a.temp))
+}
+
+// loadTrace reads temperature trace from CSV file or sqlite database
+func loadTrace(path string) (trace []traceSample, err error) {
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		trace, err = readTraceCSV(path)
+	} else {
+		trace, err = readTraceDB(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trace %s: %w", path, err)
+	}
+	sort.Slice(trace, func(i, j int) bool { return trace[i].at.Before(trace[j].at) })
+	return trace, nil
+}
+
+// readTraceCSV reads lines of datetime,temperature. Header is skipped,
+// temperature below 200 is taken as ˚C, m˚C otherwise
+func readTraceCSV(path string) ([]traceSample, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 2
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var trace []traceSample
+	for i, rec := range records {
+		s, err := parseTraceSample(rec[0], rec[1])
+		if err != nil {
+			if i == 0 {
+				continue // header
+			}
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		trace = append(trace, s)
+	}
+	return trace, nil
+}
+
+// readTraceDB reads CPU temperature of main module from sqlite database
+func readTraceDB(path string) ([]traceSample, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the database may be the one of the running service, it's never migrated nor changed
+	store, err := sqlite.NewStorage(ctx, "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	data, err := store.Read(ctx, "main")
+	if err != nil {
+		return nil, err
+	}
+	var trace []traceSample
+	for _, d := range data {
+		if d.Topic != "temp" {
+			continue
+		}
+		trace = append(trace, traceSample{at: d.Time, temp: int(d.Value)})
+	}
+	return trace, nil
+}
+
+func parseTraceSample(datetime, value string) (traceSample, error) {
+	at, err := time.ParseInLocation("2006-01-02 15:04", strings.TrimSpace(datetime), time.Local)
+	if err != nil {
+		if at, err = time.Parse(time.RFC3339, strings.TrimSpace(datetime)); err != nil {
+			return traceSample{}, err
+		}
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return traceSample{}, err
+	}
+	if v < 200 {
+		v *= 1000
+	}
+	return traceSample{at: at, temp: int(v)}, nil
+}
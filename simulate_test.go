@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/parMaster/rpid/config"
+	"github.com/parMaster/rpid/storage/sqlite"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ThermalModel(t *testing.T) {
+	m := &thermalModel{ambient: 25, heat: 40, cooling: 0.5, tau: time.Minute, temp: 25}
+	for i := 0; i < 3600; i++ {
+		m.Step(time.Second, 0)
+	}
+	assert.InDelta(t, 65, m.temp, 0.01)
+	for i := 0; i < 3600; i++ {
+		m.Step(time.Second, 100)
+	}
+	assert.InDelta(t, 45, m.temp, 0.01)
+}
+
+func Test_Trace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.csv")
+	err := os.WriteFile(path, []byte("datetime,temp\n2023-06-01 10:01,50\n2023-06-01 10:00,40000\n"), 0o600)
+	assert.NoError(t, err)
+
+	trace, err := loadTrace(path)
+	assert.NoError(t, err)
+	assert.Len(t, trace, 2)
+	assert.Equal(t, 40000, trace[0].temp)
+	assert.Equal(t, 45000, traceAt(trace, trace[0].at.Add(30*time.Second)))
+	assert.Equal(t, 50000, traceAt(trace, trace[1].at.Add(time.Hour)))
+
+	_, err = loadTrace(filepath.Join(t.TempDir(), "none.db"))
+	assert.Error(t, err)
+
+	// database of the older schema is neither read nor migrated
+	path = filepath.Join(t.TempDir(), "data.db")
+	db, err := sql.Open("sqlite3", path)
+	assert.NoError(t, err)
+	defer db.Close()
+	_, err = db.Exec("CREATE TABLE `main` (DateTime TEXT, Topic TEXT, Value TEXT); INSERT INTO `main` VALUES ('2022-03-30 00:00', 'temp', '36000')")
+	assert.NoError(t, err)
+	_, err = loadTrace(path)
+	assert.ErrorIs(t, err, sqlite.ErrSchemaOutdated)
+	var n int
+	assert.NoError(t, db.QueryRow("SELECT COUNT(*) FROM `main`").Scan(&n))
+	assert.Equal(t, 1, n)
+
+	store, err := sqlite.NewStorage(context.Background(), path)
+	assert.NoError(t, err)
+	_, _, err = store.Migrate(context.Background(), false)
+	assert.NoError(t, err)
+	trace, err = loadTrace(path)
+	assert.NoError(t, err)
+	assert.Len(t, trace, 1)
+	assert.Equal(t, 36000, trace[0].temp)
+}
+
+func Test_Simulate(t *testing.T) {
+	conf := &config.Parameters{Fan: config.Fan{ControlPin: "GPIO18", High: 48, Low: 40}}
+	cmd := SimulateCmd{Duration: time.Hour, Ambient: 25, Heat: 40, Cooling: 0.5, Tau: 2 * time.Minute}
+
+	res, err := cmd.simulate(conf.Fan, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "hysteresis", res.Policy)
+	assert.Greater(t, res.Switches, 0)
+	assert.Greater(t, res.Peak, 48.0)
+	assert.Less(t, res.Peak, 65.0)
+	assert.Greater(t, res.AboveHigh, time.Duration(0))
+
+	var out bytes.Buffer
+	cmd.Policies = []string{"hysteresis", "curve"}
+	assert.NoError(t, cmd.Run(conf, &out))
+	assert.Contains(t, out.String(), "hysteresis")
+	assert.Contains(t, out.String(), "curve policy needs at least one point")
+
+	cmd.Fan = "exhaust"
+	assert.Error(t, cmd.Run(conf, &out))
+
+	// curve policy doesn't need High, time above it isn't counted then
+	curve := config.Fan{ControlPin: "GPIO18", Policy: "curve", Curve: config.Curve{Points: []config.CurvePoint{{Temp: 40, Duty: 30}, {Temp: 60, Duty: 100}}}}
+	res, err = cmd.simulate(curve, nil)
+	assert.NoError(t, err)
+	assert.Greater(t, res.Peak, 40.0)
+	assert.Zero(t, res.AboveHigh)
+}
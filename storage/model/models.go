@@ -1,8 +1,17 @@
 package model
 
+import "time"
+
+// DateTimeFormat is the minute resolution format of the view dates and of the legacy per-module tables
+const DateTimeFormat = "2006-01-02 15:04"
+
+// Data is the measurement of the module topic. Events and documents, like fan stats,
+// are not numeric and go to Text, Value is zero then
 type Data struct {
-	Module   string
-	DateTime string
-	Topic    string
-	Value    string
+	Module string
+	Time   time.Time // capture time, the time of writing if zero
+	Topic  string
+	Value  float64
+	Unit   string // optional, like m˚C or rpm
+	Text   string // non-numeric record
 }
@@ -0,0 +1,291 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migration is the schema change, applied once in its own transaction. Versions go in order
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string                                      // statements, for plain schema changes
+	Up      func(ctx context.Context, tx *sql.Tx) error // for changes which depend on the data
+}
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrations of the schema, databases of v0.2.0 onward have per-module tables and no version
+var migrations = []Migration{
+	{Version: 1, Name: "measurements tables", SQL: migrationSQL("001_measurements.sql")},
+	{Version: 2, Name: "legacy per-module tables to measurements", Up: migrateLegacyTables},
+	{Version: 3, Name: "state table, fan stats moved to it", SQL: migrationSQL("003_state.sql")},
+	{Version: 4, Name: "unique rollup periods", SQL: migrationSQL("004_rollup_keys.sql")},
+}
+
+func migrationSQL(name string) string {
+	data, err := migrationFiles.ReadFile("migrations/" + name)
+	if err != nil {
+		panic(err) // embedded at build time
+	}
+	return string(data)
+}
+
+// MigrationState is the migration and the time it was applied, zero if it's pending
+type MigrationState struct {
+	Migration
+	Applied time.Time
+}
+
+// Migrations returns the schema version and the state of every migration. Nothing is written,
+// the database without schema_version table is of version 0
+func (s *SQLiteStorage) Migrations(ctx context.Context) (version int, states []MigrationState, err error) {
+	applied := map[int]time.Time{}
+	tracked, err := s.versioned(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !tracked {
+		for _, m := range migrations {
+			states = append(states, MigrationState{Migration: m})
+		}
+		return 0, states, nil
+	}
+
+	rows, err := s.DB.QueryContext(ctx, "SELECT version, applied FROM schema_version")
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v int
+		var ts int64
+		if err = rows.Scan(&v, &ts); err != nil {
+			return 0, nil, err
+		}
+		applied[v] = time.Unix(ts, 0)
+		version = max(version, v)
+	}
+	if err = rows.Err(); err != nil {
+		return 0, nil, err
+	}
+	for _, m := range migrations {
+		states = append(states, MigrationState{Migration: m, Applied: applied[m.Version]})
+	}
+	return version, states, nil
+}
+
+// Migrate applies pending migrations, each one in its own transaction. The database is backed up
+// next to its file first, unless it's empty. Dry run applies them all in one transaction and rolls it back
+func (s *SQLiteStorage) Migrate(ctx context.Context, dryRun bool) (applied []Migration, backup string, err error) {
+	version, states, err := s.Migrations(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	var pending []Migration
+	for _, st := range states {
+		if st.Applied.IsZero() && st.Version > version {
+			pending = append(pending, st.Migration)
+		}
+	}
+	if len(pending) == 0 {
+		return nil, "", nil
+	}
+
+	if dryRun {
+		tx, err := s.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return nil, "", err
+		}
+		defer tx.Rollback()
+		for _, m := range pending {
+			if err = m.apply(ctx, tx); err != nil {
+				return applied, "", fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+			}
+			applied = append(applied, m)
+		}
+		return applied, "", nil
+	}
+
+	if backup, err = s.backup(ctx, version); err != nil {
+		return nil, "", fmt.Errorf("backup before migration: %w", err)
+	}
+	for _, m := range pending {
+		tx, err := s.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return applied, backup, err
+		}
+		if err = m.apply(ctx, tx); err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			return applied, backup, fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		log.Printf("[INFO] Schema migrated to version %d: %s", m.Version, m.Name)
+		applied = append(applied, m)
+	}
+	return applied, backup, nil
+}
+
+// apply runs the migration and records the version
+func (m Migration) apply(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_version (version INTEGER PRIMARY KEY, name TEXT, applied INTEGER)")
+	if err == nil && m.SQL != "" {
+		_, err = tx.ExecContext(ctx, m.SQL)
+	}
+	if err == nil && m.Up != nil {
+		err = m.Up(ctx, tx)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO schema_version (version, name, applied) VALUES ($1, $2, $3)", m.Version, m.Name, time.Now().Unix())
+	return err
+}
+
+// backup copies the database file to <file>.v<version>-<time>.bak, skipped for in-memory and empty databases
+func (s *SQLiteStorage) backup(ctx context.Context, version int) (string, error) {
+	var seq int
+	var name, file string
+	if err := s.DB.QueryRowContext(ctx, "PRAGMA database_list").Scan(&seq, &name, &file); err != nil {
+		return "", err
+	}
+	var tables int
+	if err := s.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name <> 'schema_version'").Scan(&tables); err != nil {
+		return "", err
+	}
+	if file == "" || tables == 0 {
+		return "", nil
+	}
+	path := fmt.Sprintf("%s.v%d-%s.bak", file, version, time.Now().Format("20060102-150405"))
+	if _, err := s.DB.ExecContext(ctx, "VACUUM INTO $1", path); err != nil {
+		return "", err
+	}
+	log.Printf("[INFO] Database is backed up to %s", path)
+	return path, nil
+}
+
+// migrateLegacyTables moves per-module tables (DateTime TEXT, Topic TEXT, Value TEXT), and their
+// _hourly and _daily rollups, into measurements tables. Legacy local DateTime becomes UTC epoch.
+// Legacy tables are dropped once their rows are moved
+func migrateLegacyTables(ctx context.Context, tx *sql.Tx) error {
+	legacy, err := legacyTables(ctx, tx)
+	if err != nil {
+		return err
+	}
+	for _, t := range legacy {
+		name := strings.ReplaceAll(t.name, "'", "''")
+		var n int64
+		if t.tier == TierRaw {
+			n, err = migrateLegacyRaw(ctx, tx, t.name)
+		} else {
+			module := strings.TrimSuffix(strings.TrimSuffix(name, "_hourly"), "_daily")
+			var res sql.Result
+			res, err = tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (module, topic, ts, min, avg, max, count) "+
+				"SELECT '%s', Topic, CAST(strftime('%%s', DateTime, 'utc') AS INTEGER), Min, Avg, Max, Count FROM `%s`",
+				t.tier, module, t.name))
+			if err == nil {
+				n, _ = res.RowsAffected()
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("migrating %s: %w", t.name, err)
+		}
+		if _, err = tx.ExecContext(ctx, fmt.Sprintf("DROP TABLE `%s`", t.name)); err != nil {
+			return fmt.Errorf("dropping %s: %w", t.name, err)
+		}
+		log.Printf("[INFO] Migrated %d records of legacy table %s", n, t.name)
+	}
+	return nil
+}
+
+// migrateLegacyRaw moves the module table rows to measurements. Values parsed as finite numbers
+// are stored as values, events and JSON documents are kept as text
+func migrateLegacyRaw(ctx context.Context, tx *sql.Tx, table string) (n int64, err error) {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT Topic, CAST(strftime('%%s', DateTime, 'utc') AS INTEGER), Value "+
+		"FROM `%s` WHERE DateTime IS NOT NULL ORDER BY DateTime", table))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	insert, err := tx.PrepareContext(ctx, "INSERT INTO measurements (module, topic, ts, value, text) VALUES ($1, $2, $3, $4, $5)")
+	if err != nil {
+		return 0, err
+	}
+	defer insert.Close()
+
+	for rows.Next() {
+		var topic, value sql.NullString
+		var ts int64
+		if err = rows.Scan(&topic, &ts, &value); err != nil {
+			return n, err
+		}
+		var num, text any = nil, value
+		if v, err := strconv.ParseFloat(strings.TrimSpace(value.String), 64); err == nil && !math.IsNaN(v) && !math.IsInf(v, 0) {
+			num, text = v, nil
+		}
+		if _, err = insert.ExecContext(ctx, table, topic.String, ts, num, text); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+// legacyTable is the table of the per-module schema
+type legacyTable struct {
+	name string
+	tier string // rollup tier of the module table, if it's the rollup one
+}
+
+// legacyTables lists tables of the per-module schema: ones with DateTime column, rollups have Min column too
+func legacyTables(ctx context.Context, tx *sql.Tx) ([]legacyTable, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT name FROM sqlite_master WHERE type = 'table' "+
+		"AND name NOT LIKE 'sqlite_%' AND name NOT LIKE 'measurements%'")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var legacy []legacyTable
+	for _, name := range names {
+		var dt, min int
+		q := fmt.Sprintf("SELECT COUNT(name = 'DateTime' OR NULL), COUNT(name = 'Min' OR NULL) FROM pragma_table_info('%s')",
+			strings.ReplaceAll(name, "'", "''"))
+		if err = tx.QueryRowContext(ctx, q).Scan(&dt, &min); err != nil {
+			return nil, err
+		}
+		switch {
+		case dt == 0:
+			continue
+		case min > 0 && strings.HasSuffix(name, "_daily"):
+			legacy = append(legacy, legacyTable{name, TierDaily})
+		case min > 0:
+			legacy = append(legacy, legacyTable{name, TierHourly})
+		default:
+			legacy = append(legacy, legacyTable{name, TierRaw})
+		}
+	}
+	return legacy, nil
+}
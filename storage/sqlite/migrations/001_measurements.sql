@@ -0,0 +1,25 @@
+-- Normalized schema: all modules' measurements in one table, timestamps are UTC epoch seconds.
+-- Events and JSON documents go to text, value is NULL then.
+-- Tables may exist already, created before schema versions were tracked.
+CREATE TABLE IF NOT EXISTS measurements (
+	module TEXT NOT NULL,
+	topic TEXT NOT NULL,
+	ts INTEGER NOT NULL,
+	value REAL,
+	unit TEXT,
+	text TEXT
+);
+CREATE INDEX IF NOT EXISTS measurements_module_ts ON measurements (module, ts);
+
+-- Hourly and daily min/avg/max of numeric values
+CREATE TABLE IF NOT EXISTS measurements_hourly (
+	module TEXT NOT NULL, topic TEXT NOT NULL, ts INTEGER NOT NULL,
+	min REAL, avg REAL, max REAL, count INTEGER
+);
+CREATE INDEX IF NOT EXISTS measurements_hourly_module_ts ON measurements_hourly (module, ts);
+
+CREATE TABLE IF NOT EXISTS measurements_daily (
+	module TEXT NOT NULL, topic TEXT NOT NULL, ts INTEGER NOT NULL,
+	min REAL, avg REAL, max REAL, count INTEGER
+);
+CREATE INDEX IF NOT EXISTS measurements_daily_module_ts ON measurements_daily (module, ts);
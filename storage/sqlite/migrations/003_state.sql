@@ -0,0 +1,15 @@
+-- Latest value by key, replaced on every save and never pruned, like fan lifetime statistics
+CREATE TABLE IF NOT EXISTS state (
+	module TEXT NOT NULL,
+	key TEXT NOT NULL,
+	ts INTEGER NOT NULL,
+	value TEXT,
+	PRIMARY KEY (module, key)
+);
+
+-- Fan statistics used to be written to measurements every minute, only the latest ones matter
+INSERT OR REPLACE INTO state (module, key, ts, value)
+	SELECT module, topic, MAX(ts), text FROM measurements
+	WHERE module = 'fan' AND (topic = 'stats' OR topic LIKE '%\_stats' ESCAPE '\') AND text IS NOT NULL
+	GROUP BY module, topic;
+DELETE FROM measurements WHERE module = 'fan' AND (topic = 'stats' OR topic LIKE '%\_stats' ESCAPE '\');
@@ -0,0 +1,6 @@
+-- Rollups are upserted by module, topic and period start, so samples arriving late update their periods
+DELETE FROM measurements_hourly WHERE rowid NOT IN (SELECT MAX(rowid) FROM measurements_hourly GROUP BY module, topic, ts);
+CREATE UNIQUE INDEX IF NOT EXISTS measurements_hourly_key ON measurements_hourly (module, topic, ts);
+
+DELETE FROM measurements_daily WHERE rowid NOT IN (SELECT MAX(rowid) FROM measurements_daily GROUP BY module, topic, ts);
+CREATE UNIQUE INDEX IF NOT EXISTS measurements_daily_key ON measurements_daily (module, topic, ts);
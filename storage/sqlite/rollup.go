@@ -0,0 +1,156 @@
+package sqlite
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// rollup tiers, tables of measurements by resolution
+const (
+	TierRaw    = "measurements"
+	TierHourly = "measurements_hourly"
+	TierDaily  = "measurements_daily"
+)
+
+// Retention is how long every tier is kept, zero keeps it forever
+type Retention struct {
+	Raw    time.Duration
+	Hourly time.Duration
+	Daily  time.Duration
+}
+
+// Downsample rolls up and prunes data every period, until ctx is done
+func (s *SQLiteStorage) Downsample(ctx context.Context, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		if err := s.Rollup(ctx, time.Now()); err != nil {
+			log.Printf("[ERROR] Failed to roll up data: %v", err)
+		} else if err := s.Prune(ctx, time.Now()); err != nil {
+			log.Printf("[ERROR] Failed to prune data: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// local hour and day starts of the epoch column, days are cut on local midnight like they are displayed
+const (
+	localHour = "CAST(strftime('%%s', strftime('%%Y-%%m-%%d %%H:00:00', %[1]s, 'unixepoch', 'localtime'), 'utc') AS INTEGER)"
+	localDay  = "CAST(strftime('%%s', %[1]s, 'unixepoch', 'localtime', 'start of day', 'utc') AS INTEGER)"
+)
+
+// Rollup writes hourly and daily min/avg/max of every numeric module topic, for the local hours and days
+// completed by now. Periods after the latest rolled up one of the module topic are written, and the recent
+// ones are written over, so samples arriving late and modules starting late are rolled up too.
+// Daily rollups are made of hourly ones
+func (s *SQLiteStorage) Rollup(ctx context.Context, now time.Time) error {
+	if err := s.init(ctx); err != nil {
+		return err
+	}
+	now = now.Local()
+	hour := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, time.Local)
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	recentHours, recentDays := hour.Add(-24*time.Hour), day.AddDate(0, 0, -1)
+	if s.Retention != nil {
+		// periods partially pruned from their source already are never written over
+		recentHours = laterOf(recentHours, nextHour(now.Add(-s.Retention.Raw)), s.Retention.Raw)
+		recentDays = laterOf(recentDays, nextDay(now.Add(-s.Retention.Hourly)), s.Retention.Hourly)
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "WITH rolled AS (SELECT module, topic, MAX(ts) AS ts FROM measurements_hourly GROUP BY module, topic) "+
+		"INSERT INTO measurements_hourly (module, topic, ts, min, avg, max, count) "+
+		"SELECT m.module, m.topic, "+fmt.Sprintf(localHour, "m.ts")+" AS hour, MIN(m.value), AVG(m.value), MAX(m.value), COUNT(*) "+
+		"FROM measurements m LEFT JOIN rolled r ON r.module = m.module AND r.topic = m.topic "+
+		"WHERE m.value IS NOT NULL AND m.ts < $1 AND (m.ts >= IFNULL(r.ts + 3600, 0) OR m.ts >= $2) "+
+		"GROUP BY m.module, m.topic, hour "+
+		"ON CONFLICT (module, topic, ts) DO UPDATE SET min = excluded.min, avg = excluded.avg, max = excluded.max, count = excluded.count",
+		hour.Unix(), recentHours.Unix())
+	if err != nil {
+		return fmt.Errorf("hourly rollup: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, "WITH rolled AS (SELECT module, topic, MAX(ts) AS ts FROM measurements_daily GROUP BY module, topic) "+
+		"INSERT INTO measurements_daily (module, topic, ts, min, avg, max, count) "+
+		"SELECT h.module, h.topic, "+fmt.Sprintf(localDay, "h.ts")+" AS day, MIN(h.min), SUM(h.avg * h.count) / SUM(h.count), MAX(h.max), SUM(h.count) "+
+		"FROM measurements_hourly h LEFT JOIN rolled r ON r.module = h.module AND r.topic = h.topic "+
+		"WHERE h.ts < $1 AND (h.ts > IFNULL(r.ts, -1) AND "+fmt.Sprintf(localDay, "h.ts")+" > IFNULL(r.ts, -1) OR h.ts >= $2) "+
+		"GROUP BY h.module, h.topic, day "+
+		"ON CONFLICT (module, topic, ts) DO UPDATE SET min = excluded.min, avg = excluded.avg, max = excluded.max, count = excluded.count",
+		day.Unix(), recentDays.Unix())
+	if err != nil {
+		return fmt.Errorf("daily rollup: %w", err)
+	}
+	return tx.Commit()
+}
+
+// laterOf returns the later time, the first one if there is no retention
+func laterOf(t, kept time.Time, keep time.Duration) time.Time {
+	if keep > 0 && kept.After(t) {
+		return kept
+	}
+	return t
+}
+
+// nextHour returns the start of the local hour after t
+func nextHour(t time.Time) time.Time {
+	t = t.Local()
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, time.Local)
+}
+
+// nextDay returns the start of the local day after t
+func nextDay(t time.Time) time.Time {
+	t = t.Local()
+	return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.Local)
+}
+
+// Prune deletes data older than its tier retention. Rolled up data only is expected to be pruned,
+// so Rollup goes first
+func (s *SQLiteStorage) Prune(ctx context.Context, now time.Time) error {
+	if s.Retention == nil {
+		return nil
+	}
+	if err := s.init(ctx); err != nil {
+		return err
+	}
+	for tier, keep := range map[string]time.Duration{TierRaw: s.Retention.Raw, TierHourly: s.Retention.Hourly, TierDaily: s.Retention.Daily} {
+		if keep <= 0 {
+			continue
+		}
+		res, err := s.DB.ExecContext(ctx, "DELETE FROM "+tier+" WHERE ts < $1", now.Add(-keep).Unix())
+		if err != nil {
+			return fmt.Errorf("pruning %s: %w", tier, err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			log.Printf("[DEBUG] Pruned %d %s records older than %s", n, tier, keep)
+		}
+	}
+	return nil
+}
+
+// Tier picks the rollup tier for the time range: the finest one still keeping its start,
+// with a reasonable number of points to draw
+func (s *SQLiteStorage) Tier(now, from, to time.Time) string {
+	if s.Retention == nil {
+		return TierRaw // not downsampled
+	}
+	kept := func(keep time.Duration) bool { return keep <= 0 || !from.Before(now.Add(-keep)) }
+	span := to.Sub(from)
+	switch {
+	case span <= 2*24*time.Hour && kept(s.Retention.Raw):
+		return TierRaw
+	case span <= 90*24*time.Hour && kept(s.Retention.Hourly):
+		return TierHourly
+	}
+	return TierDaily
+}
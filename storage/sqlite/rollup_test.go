@@ -0,0 +1,99 @@
+package sqlite
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/parMaster/rpid/storage/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SqliteStorage_Rollup(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store, err := NewStorage(ctx, filepath.Join(t.TempDir(), "rollup.db"))
+	assert.NoError(t, err)
+	_, _, err = store.Migrate(ctx, false)
+	assert.NoError(t, err)
+
+	// two days by minute, temp goes 0..59 every hour. Days are cut on local midnight
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	for i := 0; i < 2*24*60; i++ {
+		at := start.Add(time.Duration(i) * time.Minute)
+		assert.NoError(t, store.Write(ctx, model.Data{Module: "main", Time: at, Topic: "temp", Value: float64(i % 60)}))
+	}
+	assert.NoError(t, store.Write(ctx, model.Data{Module: "main", Time: start.Add(30 * time.Minute), Topic: "stats", Text: `{"Starts":1}`}))
+
+	// second day isn't complete yet
+	now := start.Add(47*time.Hour + 30*time.Minute)
+	assert.NoError(t, store.Rollup(ctx, now))
+	assert.NoError(t, store.Rollup(ctx, now)) // nothing new
+
+	count := func(table string) (n int) {
+		assert.NoError(t, store.DB.QueryRow("SELECT COUNT(*) FROM "+table).Scan(&n))
+		return n
+	}
+	var min, avg, max float64
+	var n int
+	assert.Equal(t, 47, count(TierHourly), "complete hours of temp, stats aren't numeric")
+	assert.NoError(t, store.DB.QueryRow("SELECT min, avg, max, count FROM measurements_hourly WHERE ts = $1", start.Add(5*time.Hour).Unix()).Scan(&min, &avg, &max, &n))
+	assert.Equal(t, []float64{0, 29.5, 59}, []float64{min, avg, max})
+	assert.Equal(t, 60, n)
+	assert.Equal(t, 1, count(TierDaily))
+	var ts int64
+	assert.NoError(t, store.DB.QueryRow("SELECT ts, avg, count FROM measurements_daily").Scan(&ts, &avg, &n))
+	assert.Equal(t, start.Unix(), ts)
+	assert.Equal(t, 29.5, avg)
+	assert.Equal(t, 24*60, n)
+
+	// late sample of the recent hour is rolled up over it
+	assert.NoError(t, store.Write(ctx, model.Data{Module: "main", Time: start.Add(40*time.Hour + 30*time.Second), Topic: "temp", Value: 1000}))
+	// module starting late writes periods which are rolled up for other modules already
+	assert.NoError(t, store.Write(ctx, model.Data{Module: "zones", Time: start.Add(10 * time.Hour), Topic: "temp", Value: 20}))
+	assert.NoError(t, store.Rollup(ctx, now))
+	assert.Equal(t, 48, count(TierHourly))
+	assert.NoError(t, store.DB.QueryRow("SELECT max, count FROM measurements_hourly WHERE module = 'main' AND ts = $1", start.Add(40*time.Hour).Unix()).Scan(&max, &n))
+	assert.Equal(t, 1000.0, max)
+	assert.Equal(t, 61, n)
+	assert.NoError(t, store.DB.QueryRow("SELECT avg FROM measurements_daily WHERE module = 'zones' AND ts = $1", start.Unix()).Scan(&avg))
+	assert.Equal(t, 20.0, avg)
+
+	// the rest is rolled up next day
+	assert.NoError(t, store.Rollup(ctx, start.Add(49*time.Hour)))
+	assert.Equal(t, 49, count(TierHourly))
+	assert.Equal(t, 3, count(TierDaily))
+	assert.NoError(t, store.DB.QueryRow("SELECT max FROM measurements_daily WHERE module = 'main' AND ts = $1", start.AddDate(0, 0, 1).Unix()).Scan(&max))
+	assert.Equal(t, 1000.0, max)
+
+	// raw data is pruned, rollups are kept
+	store.Retention = &Retention{Raw: 24 * time.Hour, Hourly: 365 * 24 * time.Hour}
+	now = start.Add(49*time.Hour + 30*time.Minute)
+	assert.NoError(t, store.Prune(ctx, now))
+	data, err := store.Read(ctx, "main")
+	assert.NoError(t, err)
+	assert.Equal(t, 24*60-90+1, len(data))
+	assert.Equal(t, 49, count(TierHourly))
+
+	// periods partially pruned aren't rolled up over
+	assert.NoError(t, store.Rollup(ctx, now))
+	assert.NoError(t, store.DB.QueryRow("SELECT count FROM measurements_hourly WHERE module = 'main' AND ts = $1", start.Add(25*time.Hour).Unix()).Scan(&n))
+	assert.Equal(t, 60, n)
+
+	// tier is picked by range and retention
+	assert.Equal(t, TierRaw, store.Tier(now, now.Add(-2*time.Hour), now))
+	assert.Equal(t, TierHourly, store.Tier(now, now.Add(-48*time.Hour), now), "raw data is pruned")
+	assert.Equal(t, TierHourly, store.Tier(now, now.Add(-30*24*time.Hour), now))
+	assert.Equal(t, TierDaily, store.Tier(now, now.Add(-200*24*time.Hour), now))
+	assert.Equal(t, TierDaily, store.Tier(now, now.Add(-400*24*time.Hour), now.Add(-399*24*time.Hour)))
+
+	// pruned raw data is read from hourly rollups, kept forever
+	store.Retention = &Retention{Raw: 24 * time.Hour}
+	view, err := store.View(ctx, "main", start, start.Add(5*time.Hour))
+	assert.NoError(t, err)
+	assert.Len(t, view["temp"], 6)
+	assert.Equal(t, 29.5, view["temp"][start.Add(5*time.Hour).Local().Format(model.DateTimeFormat)])
+}
@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -12,8 +13,10 @@ import (
 )
 
 type SQLiteStorage struct {
-	DB            *sql.DB
-	activeModules map[string]bool
+	DB        *sql.DB
+	Retention *Retention // rollup tiers retention, nil if data isn't downsampled
+	mx        sync.Mutex
+	ready     bool // schema is checked to be of the latest version
 }
 
 func NewStorage(ctx context.Context, path string) (*SQLiteStorage, error) {
@@ -27,34 +30,48 @@ func NewStorage(ctx context.Context, path string) (*SQLiteStorage, error) {
 		sqliteDatabase.Close()
 	}()
 
-	return &SQLiteStorage{DB: sqliteDatabase, activeModules: make(map[string]bool)}, nil
+	return &SQLiteStorage{DB: sqliteDatabase}, nil
 }
 
 func (s *SQLiteStorage) Write(ctx context.Context, d model.Data) error {
 
-	if ok, err := s.moduleActive(ctx, d.Module); err != nil || !ok {
-		return err
-	}
-
-	if d.DateTime == "" {
-		d.DateTime = time.Now().Format("2006-01-02 15:04")
+	if d.Module == "" {
+		return errors.New("module name is empty")
 	}
 
 	if d.Topic == "" {
 		return errors.New("topic is empty")
 	}
 
-	q := fmt.Sprintf("INSERT INTO `%s` VALUES ($1, $2, $3)", d.Module)
+	if err := s.init(ctx); err != nil {
+		return err
+	}
 
-	_, err := s.DB.ExecContext(ctx, q, d.DateTime, d.Topic, d.Value)
+	if d.Time.IsZero() {
+		d.Time = time.Now()
+	}
+
+	// non-numeric records have no value
+	value, text := sql.NullFloat64{Float64: d.Value, Valid: d.Text == ""}, sql.NullString{String: d.Text, Valid: d.Text != ""}
+	_, err := s.DB.ExecContext(ctx, "INSERT INTO measurements (module, topic, ts, value, unit, text) VALUES ($1, $2, $3, $4, $5, $6)",
+		d.Module, d.Topic, d.Time.Unix(), value, sql.NullString{String: d.Unit, Valid: d.Unit != ""}, text)
 	return err
 }
 
-// Read reads records for the given module from the database
+// Read reads records for the given module from the database, oldest first
 func (s *SQLiteStorage) Read(ctx context.Context, module string) (data []model.Data, err error) {
+	return s.ReadSince(ctx, module, time.Time{})
+}
+
+// ReadSince reads records for the given module, taken at or after the given time, oldest first
+func (s *SQLiteStorage) ReadSince(ctx context.Context, module string, from time.Time) (data []model.Data, err error) {
 
-	q := fmt.Sprintf("SELECT * FROM `%s`", module)
-	rows, err := s.DB.QueryContext(ctx, q)
+	if err := s.init(ctx); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.DB.QueryContext(ctx, "SELECT topic, ts, value, unit, text FROM measurements WHERE module = $1 AND ts >= $2 ORDER BY ts, rowid",
+		module, from.Unix())
 	if err != nil {
 		return nil, err
 	}
@@ -62,85 +79,122 @@ func (s *SQLiteStorage) Read(ctx context.Context, module string) (data []model.D
 
 	for rows.Next() {
 		d := model.Data{Module: module}
-		err = rows.Scan(&d.DateTime, &d.Topic, &d.Value)
+		var ts int64
+		var value sql.NullFloat64
+		var unit, text sql.NullString
+		err = rows.Scan(&d.Topic, &ts, &value, &unit, &text)
 		if err != nil {
 			return nil, err
 		}
+		d.Time, d.Value, d.Unit, d.Text = time.Unix(ts, 0), value.Float64, unit.String, text.String
 		data = append(data, d)
 	}
 
-	return
+	return data, rows.Err()
 }
 
-// View returns a map of topics and their values for the given module
+// View returns a map of numeric topics and their values for the given module, within the time range.
+// Long ranges are read from hourly or daily rollups, values are averages then.
 // The map is sorted by DateTime and structured as follows:
 // map[Topic]map[DateTime]Value
-func (s *SQLiteStorage) View(ctx context.Context, module string) (data map[string]map[string]string, err error) {
+func (s *SQLiteStorage) View(ctx context.Context, module string, from, to time.Time) (data map[string]map[string]float64, err error) {
 
-	data = make(map[string]map[string]string)
+	if err := s.init(ctx); err != nil {
+		return nil, err
+	}
 
-	// select distinct topics from module
-	q := fmt.Sprintf("SELECT DISTINCT Topic FROM `%s`", module)
-	rows, err := s.DB.QueryContext(ctx, q)
+	q := "SELECT topic, ts, value FROM measurements WHERE module = $1 AND ts >= $2 AND ts <= $3 AND value IS NOT NULL ORDER BY ts"
+	if tier := s.Tier(time.Now(), from, to); tier != TierRaw {
+		q = "SELECT topic, ts, avg FROM " + tier + " WHERE module = $1 AND ts >= $2 AND ts <= $3 ORDER BY ts"
+	}
+	rows, err := s.DB.QueryContext(ctx, q, module, from.Unix(), to.Unix())
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	data = make(map[string]map[string]float64)
 	for rows.Next() {
 		var topic string
-		err = rows.Scan(&topic)
-		if err != nil {
+		var ts int64
+		var v float64
+		if err = rows.Scan(&topic, &ts, &v); err != nil {
 			return nil, err
 		}
-		data[topic] = make(map[string]string)
+		if data[topic] == nil {
+			data[topic] = make(map[string]float64)
+		}
+		data[topic][time.Unix(ts, 0).Format(model.DateTimeFormat)] = v
 	}
 
-	// select all records from module and fill the map
-	q = fmt.Sprintf("SELECT * FROM `%s` ORDER BY DateTime", module)
-	rows, err = s.DB.QueryContext(ctx, q)
-	if err != nil {
-		return nil, err
-	}
+	return data, rows.Err()
+}
 
-	for rows.Next() {
-		d := model.Data{Module: module}
-		err = rows.Scan(&d.DateTime, &d.Topic, &d.Value)
-		if err != nil {
-			return nil, err
-		}
-		data[d.Topic][d.DateTime] = d.Value
+// SaveState replaces the value kept for the module key. Unlike measurements, state isn't pruned
+func (s *SQLiteStorage) SaveState(ctx context.Context, module, key, value string) error {
+	if err := s.init(ctx); err != nil {
+		return err
 	}
+	_, err := s.DB.ExecContext(ctx, "INSERT INTO state (module, key, ts, value) VALUES ($1, $2, $3, $4) "+
+		"ON CONFLICT (module, key) DO UPDATE SET ts = excluded.ts, value = excluded.value",
+		module, key, time.Now().Unix(), value)
+	return err
+}
 
-	return
+// LoadState returns the value kept for the module key, empty if there is none
+func (s *SQLiteStorage) LoadState(ctx context.Context, module, key string) (string, error) {
+	if err := s.init(ctx); err != nil {
+		return "", err
+	}
+	var value sql.NullString
+	err := s.DB.QueryRowContext(ctx, "SELECT value FROM state WHERE module = $1 AND key = $2", module, key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return value.String, err
 }
 
-// Check if the table exists, create if not. Cache the result in the map
-func (s *SQLiteStorage) moduleActive(ctx context.Context, module string) (bool, error) {
+// ErrSchemaOutdated is returned when the database schema isn't migrated to the latest version
+var ErrSchemaOutdated = errors.New("schema is outdated, run rpid migrate --up")
 
-	if module == "" {
-		return false, errors.New("module name is empty")
+// SchemaVersion returns the version the schema is migrated to, without creating anything
+func (s *SQLiteStorage) SchemaVersion(ctx context.Context) (version int, err error) {
+	if tracked, err := s.versioned(ctx); err != nil || !tracked {
+		return 0, err
 	}
+	err = s.DB.QueryRowContext(ctx, "SELECT IFNULL(MAX(version), 0) FROM schema_version").Scan(&version)
+	return version, err
+}
 
-	if s.activeModules[module] {
-		return true, nil
-	}
+// versioned reports if schema_version table exists, it's created by the first migration
+func (s *SQLiteStorage) versioned(ctx context.Context) (bool, error) {
+	var n int
+	err := s.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'").Scan(&n)
+	return n > 0, err
+}
 
-	if _, ok := s.activeModules[module]; !ok {
-		q := fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%s` (DateTime TEXT, Topic TEXT, Value TEXT)", module)
-		_, err := s.DB.ExecContext(ctx, q)
-		if err != nil {
-			return false, err
-		}
-		s.activeModules[module] = true
+// init checks the schema is migrated to the latest version, once. Migrations are applied
+// by the service at start and by migrate command only
+func (s *SQLiteStorage) init(ctx context.Context) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.ready {
+		return nil
 	}
-
-	return true, nil
+	version, err := s.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if latest := migrations[len(migrations)-1].Version; version < latest {
+		return fmt.Errorf("schema version %d, %d expected: %w", version, latest, ErrSchemaOutdated)
+	}
+	s.ready = true
+	return nil
 }
 
-// Cleanup removes the table for the given module
+// Cleanup removes the records of the given module
 func (s *SQLiteStorage) Cleanup(module string) {
-	q := fmt.Sprintf("DROP TABLE `%s`", module)
-	s.DB.Exec(q)
-	delete(s.activeModules, module)
+	for _, table := range []string{TierRaw, TierHourly, TierDaily, "state"} {
+		s.DB.Exec("DELETE FROM "+table+" WHERE module = $1", module)
+	}
 }
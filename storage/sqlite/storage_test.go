@@ -3,6 +3,7 @@ package sqlite
 import (
 	"context"
 	"log"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -20,12 +21,15 @@ func Test_SqliteStorage(t *testing.T) {
 	if err != nil {
 		log.Printf("[ERROR] Failed to open SQLite storage: %e", err)
 	}
+	_, _, err = store.Migrate(ctx, false)
+	assert.NoError(t, err)
 
 	testRecord := model.Data{
-		Module:   "testModule",
-		DateTime: "2019-01-01 00:00",
-		Topic:    "testTopic",
-		Value:    "testValue",
+		Module: "testModule",
+		Time:   time.Date(2019, 1, 1, 0, 0, 0, 0, time.Local),
+		Topic:  "testTopic",
+		Value:  36.6,
+		Unit:   "˚C",
 	}
 
 	store.Cleanup(testRecord.Module)
@@ -48,26 +52,31 @@ func Test_SqliteStorage(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, data[1], testRecord)
 
-	// test if the module is not active (no such table)
+	// no records of the module
 	data, err = store.Read(ctx, "notable")
-	assert.Nil(t, data)
-	assert.Error(t, err)
+	assert.Empty(t, data)
+	assert.NoError(t, err)
 
 	// empty topic is not allowed
-	err = store.Write(ctx, model.Data{Module: "testModule", Topic: "", Value: "testValue"})
+	err = store.Write(ctx, model.Data{Module: "testModule", Topic: "", Value: 1})
 	assert.Error(t, err)
 
-	// empty value is allowed
-	err = store.Write(ctx, model.Data{Module: "testModule", Topic: "testTopic", Value: ""})
+	// zero value is allowed
+	err = store.Write(ctx, model.Data{Module: "testModule", Topic: "testTopic"})
+	assert.NoError(t, err)
+
+	// non-numeric records are kept as text
+	err = store.Write(ctx, model.Data{Module: "testModule", Topic: "event", Text: "fan on", Time: testRecord.Time})
 	assert.NoError(t, err)
 
-	// Test if the date time is set to the current time if it is not set.
-	dt := time.Now().Format("2006-01-02 15:04")
-	err = store.Write(ctx, model.Data{Module: "testModule", Topic: "testTopic", Value: "testValue"})
+	// Test if the time is set to the current time if it is not set.
+	before := time.Now().Truncate(time.Second)
+	err = store.Write(ctx, model.Data{Module: "testModule", Topic: "testTopic", Value: 1})
 	assert.NoError(t, err)
 	savedValues, err := store.Read(ctx, "testModule")
 	assert.NoError(t, err)
-	assert.Equal(t, dt, savedValues[len(savedValues)-1].DateTime)
+	assert.False(t, savedValues[len(savedValues)-1].Time.Before(before))
+	assert.Contains(t, savedValues, model.Data{Module: "testModule", Topic: "event", Text: "fan on", Time: testRecord.Time})
 
 	v, _ := store.Read(ctx, "testModule")
 	n := 100
@@ -90,16 +99,20 @@ func Test_SqliteStorage_View(t *testing.T) {
 	if err != nil {
 		log.Printf("[ERROR] Failed to open SQLite storage: %e", err)
 	}
+	_, _, err = store.Migrate(ctx, false)
+	assert.NoError(t, err)
 
 	records := []model.Data{
-		{Module: "view", DateTime: "2022-03-30 00:00", Topic: "temp", Value: "36000"},
-		{Module: "view", DateTime: "2022-03-30 00:01", Topic: "temp", Value: "36100"},
-		{Module: "view", DateTime: "2022-03-30 00:02", Topic: "temp", Value: "36200"},
-		{Module: "view", DateTime: "2022-03-30 00:00", Topic: "rpm", Value: "100"},
-		{Module: "view", DateTime: "2022-03-30 00:01", Topic: "rpm", Value: "200"},
-		{Module: "view", DateTime: "2022-03-30 00:02", Topic: "rpm", Value: "300"},
+		{Module: "view", Time: at("2022-03-30 00:00"), Topic: "temp", Value: 36000},
+		{Module: "view", Time: at("2022-03-30 00:01"), Topic: "temp", Value: 36100},
+		{Module: "view", Time: at("2022-03-30 00:02"), Topic: "temp", Value: 36200},
+		{Module: "view", Time: at("2022-03-30 00:00"), Topic: "rpm", Value: 100},
+		{Module: "view", Time: at("2022-03-30 00:01"), Topic: "rpm", Value: 200},
+		{Module: "view", Time: at("2022-03-30 00:02"), Topic: "rpm", Value: 300},
+		{Module: "view", Time: at("2022-03-30 00:02"), Topic: "event", Text: "not in the view"},
 	}
 
+	store.Cleanup("view")
 	for _, r := range records {
 		err = store.Write(ctx, r)
 		assert.NoError(t, err)
@@ -107,23 +120,57 @@ func Test_SqliteStorage_View(t *testing.T) {
 
 	// test if the view is created
 
-	viewExpected := map[string]map[string]string{
+	viewExpected := map[string]map[string]float64{
 		"temp": {
-			"2022-03-30 00:00": "36000",
-			"2022-03-30 00:01": "36100",
-			"2022-03-30 00:02": "36200",
+			"2022-03-30 00:00": 36000,
+			"2022-03-30 00:01": 36100,
+			"2022-03-30 00:02": 36200,
 		},
 		"rpm": {
-			"2022-03-30 00:00": "100",
-			"2022-03-30 00:01": "200",
-			"2022-03-30 00:02": "300",
+			"2022-03-30 00:00": 100,
+			"2022-03-30 00:01": 200,
+			"2022-03-30 00:02": 300,
 		},
 	}
 
-	view, err := store.View(ctx, "view") // create the view
+	view, err := store.View(ctx, "view", time.Time{}, time.Now()) // create the view
 	assert.NoError(t, err)
 	assert.Equal(t, viewExpected, view)
 
+	// records since the time, ordered
+	since, err := store.ReadSince(ctx, "view", at("2022-03-30 00:01"))
+	assert.NoError(t, err)
+	assert.Len(t, since, 5)
+	assert.Equal(t, at("2022-03-30 00:01"), since[0].Time)
+	assert.Equal(t, at("2022-03-30 00:02"), since[4].Time)
+
+}
+
+func Test_SqliteStorage_State(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store, err := NewStorage(ctx, filepath.Join(t.TempDir(), "state.db"))
+	assert.NoError(t, err)
+	_, _, err = store.Migrate(ctx, false)
+	assert.NoError(t, err)
+	store.Retention = &Retention{Raw: time.Hour}
+
+	v, err := store.LoadState(ctx, "fan", "stats")
+	assert.NoError(t, err)
+	assert.Empty(t, v)
+
+	assert.NoError(t, store.SaveState(ctx, "fan", "stats", `{"Starts":1}`))
+	assert.NoError(t, store.SaveState(ctx, "fan", "stats", `{"Starts":2}`))
+	assert.NoError(t, store.Prune(ctx, time.Now().Add(24*time.Hour)))
+	v, err = store.LoadState(ctx, "fan", "stats")
+	assert.NoError(t, err)
+	assert.Equal(t, `{"Starts":2}`, v)
+
+	var n int
+	assert.NoError(t, store.DB.QueryRow("SELECT COUNT(*) FROM state").Scan(&n))
+	assert.Equal(t, 1, n, "single record is kept")
 }
 
 func Test_SqliteStorage_readOnly(t *testing.T) {
@@ -137,14 +184,148 @@ func Test_SqliteStorage_readOnly(t *testing.T) {
 		log.Printf("[ERROR] Failed to open SQLite storage: %e", err)
 	}
 
-	err = store.Write(ctx, model.Data{Module: "testModule", Topic: "testTopic", Value: "testValue"})
+	err = store.Write(ctx, model.Data{Module: "testModule", Topic: "testTopic", Value: 1})
 	assert.Error(t, err)
 	assert.Equal(t, "attempt to write a readonly database", err.Error())
 
 	s, err := NewStorage(ctx, "file:test_notcreated.db?mode=ro")
 	assert.NotNil(t, s)
 	assert.NoError(t, err)
-	err = s.Write(ctx, model.Data{Module: "testModule", Topic: "testTopic", Value: "testValue"})
+	err = s.Write(ctx, model.Data{Module: "testModule", Topic: "testTopic", Value: 1})
 	assert.Error(t, err)
 	assert.Equal(t, "unable to open database file: no such file or directory", err.Error())
 }
+
+func Test_SqliteStorage_migrateLegacy(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	store, err := NewStorage(ctx, filepath.Join(dir, "legacy.db"))
+	assert.NoError(t, err)
+
+	// per-module tables as v0.2.0 onward created them, with rollups
+	for _, q := range []string{
+		"CREATE TABLE `main` (DateTime TEXT, Topic TEXT, Value TEXT)",
+		"INSERT INTO `main` VALUES ('2022-03-30 00:01', 'temp', '36100'), ('2022-03-30 00:00', 'temp', '36000'), ('2022-03-30 00:00', 'rpm', '')",
+		"INSERT INTO `main` VALUES ('2022-03-30 00:02', 'load', '-1.5e-1'), ('2022-03-30 00:02', 'e', 'e'), ('2022-03-30 00:02', 'minus', '-'), ('2022-03-30 00:02', 'range', '1-2'), ('2022-03-30 00:02', 'plus', '+.')",
+		"CREATE TABLE `fan` (DateTime TEXT, Topic TEXT, Value TEXT)",
+		"INSERT INTO `fan` VALUES ('2022-03-30 00:00', 'stats', '{\"Starts\":1}'), ('2022-03-30 00:01', 'stats', '{\"Starts\":2}')",
+		"INSERT INTO `fan` VALUES ('2022-03-30 00:01', 'case_shadow', '{\"Duty\":40}')",
+		"CREATE TABLE `main_hourly` (DateTime TEXT, Topic TEXT, Min REAL, Avg REAL, Max REAL, Count INTEGER)",
+		"INSERT INTO `main_hourly` VALUES ('2022-03-30 00:00', 'temp', 36000, 36050, 36100, 2)",
+	} {
+		_, err = store.DB.Exec(q)
+		assert.NoError(t, err, q)
+	}
+
+	// outdated schema isn't read until it's migrated
+	_, err = store.Read(ctx, "main")
+	assert.ErrorIs(t, err, ErrSchemaOutdated)
+	_, _, err = store.Migrate(ctx, false)
+	assert.NoError(t, err)
+
+	data, err := store.Read(ctx, "main")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []model.Data{
+		{Module: "main", Time: at("2022-03-30 00:00"), Topic: "temp", Value: 36000},
+		{Module: "main", Time: at("2022-03-30 00:00"), Topic: "rpm", Text: ""},
+		{Module: "main", Time: at("2022-03-30 00:01"), Topic: "temp", Value: 36100},
+		{Module: "main", Time: at("2022-03-30 00:02"), Topic: "load", Value: -0.15},
+		{Module: "main", Time: at("2022-03-30 00:02"), Topic: "e", Text: "e"},
+		{Module: "main", Time: at("2022-03-30 00:02"), Topic: "minus", Text: "-"},
+		{Module: "main", Time: at("2022-03-30 00:02"), Topic: "range", Text: "1-2"},
+		{Module: "main", Time: at("2022-03-30 00:02"), Topic: "plus", Text: "+."},
+	}, data)
+	// fan stats are moved to state, events stay
+	data, err = store.Read(ctx, "fan")
+	assert.NoError(t, err)
+	assert.Len(t, data, 1)
+	assert.Equal(t, "case_shadow", data[0].Topic)
+	stats, err := store.LoadState(ctx, "fan", "stats")
+	assert.NoError(t, err)
+	assert.Equal(t, `{"Starts":2}`, stats)
+
+	var n int
+	assert.NoError(t, store.DB.QueryRow("SELECT COUNT(*) FROM measurements_hourly WHERE module = 'main' AND avg = 36050").Scan(&n))
+	assert.Equal(t, 1, n)
+	assert.NoError(t, store.DB.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name IN ('main', 'fan', 'main_hourly')").Scan(&n))
+	assert.Equal(t, 0, n, "legacy tables are dropped")
+
+	// legacy database is backed up before migration
+	backups, err := filepath.Glob(filepath.Join(dir, "legacy.db.v0-*.bak"))
+	assert.NoError(t, err)
+	assert.Len(t, backups, 1)
+}
+
+func Test_SqliteStorage_Migrations(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "migrations.db")
+	store, err := NewStorage(ctx, path)
+	assert.NoError(t, err)
+
+	// the database of v0.2.0
+	_, err = store.DB.Exec("CREATE TABLE `main` (DateTime TEXT, Topic TEXT, Value TEXT); INSERT INTO `main` VALUES ('2022-03-30 00:00', 'temp', '36000')")
+	assert.NoError(t, err)
+
+	version, states, err := store.Migrations(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, version)
+	assert.Len(t, states, len(migrations))
+	for _, st := range states {
+		assert.True(t, st.Applied.IsZero())
+	}
+
+	// dry run changes nothing
+	applied, backup, err := store.Migrate(ctx, true)
+	assert.NoError(t, err)
+	assert.Len(t, applied, len(migrations))
+	assert.Empty(t, backup)
+	version, _, err = store.Migrations(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, version)
+	var n int
+	assert.NoError(t, store.DB.QueryRow("SELECT COUNT(*) FROM `main`").Scan(&n))
+	assert.Equal(t, 1, n)
+
+	applied, backup, err = store.Migrate(ctx, false)
+	assert.NoError(t, err)
+	assert.Len(t, applied, len(migrations))
+	assert.FileExists(t, backup)
+	version, states, err = store.Migrations(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, migrations[len(migrations)-1].Version, version)
+	for _, st := range states {
+		assert.False(t, st.Applied.IsZero())
+	}
+
+	// up to date, no backup
+	applied, backup, err = store.Migrate(ctx, false)
+	assert.NoError(t, err)
+	assert.Empty(t, applied)
+	assert.Empty(t, backup)
+
+	// failed migration is rolled back, the version stays
+	migrations = append(migrations, Migration{Version: 100, Name: "broken", SQL: "CREATE TABLE broken (x INTEGER); SELECT * FROM nowhere"})
+	defer func() { migrations = migrations[:len(migrations)-1] }()
+	_, _, err = store.Migrate(ctx, false)
+	assert.Error(t, err)
+	assert.NoError(t, store.DB.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'broken'").Scan(&n))
+	assert.Equal(t, 0, n)
+	version, _, err = store.Migrations(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, migrations[len(migrations)-2].Version, version)
+}
+
+// at parses the local time in minute resolution
+func at(dt string) time.Time {
+	t, err := time.ParseInLocation(model.DateTimeFormat, dt, time.Local)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
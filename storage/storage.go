@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/parMaster/rpid/config"
 	"github.com/parMaster/rpid/storage/model"
@@ -15,20 +16,35 @@ import (
 type Storer interface {
 	// Read reads records for the given module from the database.
 	Read(context.Context, string) ([]model.Data, error)
+	// ReadSince reads records for the given module written at or after the given time, oldest first.
+	ReadSince(context.Context, string, time.Time) ([]model.Data, error)
 	// Write writes the data to the database.
 	Write(context.Context, model.Data) error
-	// View returns the data for the given module in the format that is suitable for the web view.
-	View(context.Context, string) (map[string]map[string]string, error)
+	// SaveState replaces the single value kept for the module key, like lifetime statistics. It isn't pruned.
+	SaveState(ctx context.Context, module, key, value string) error
+	// LoadState returns the value kept for the module key, empty if there is none.
+	LoadState(ctx context.Context, module, key string) (string, error)
+	// View returns the data for the given module within the time range, in the format that is suitable for the web view.
+	View(ctx context.Context, module string, from, to time.Time) (map[string]map[string]float64, error)
 }
 
 func Load(ctx context.Context, cfg config.Storage, s *Storer) error {
 	var err error
 	switch cfg.Type {
 	case "sqlite":
-		*s, err = sqlite.NewStorage(ctx, cfg.Path)
+		st, err := sqlite.NewStorage(ctx, cfg.Path)
 		if err != nil {
 			return fmt.Errorf("failed to init SQLite storage: %e", err)
 		}
+		if !cfg.ReadOnly {
+			if _, _, err := st.Migrate(ctx, false); err != nil {
+				return fmt.Errorf("failed to migrate SQLite storage: %w", err)
+			}
+			r := cfg.Retention.WithDefaults()
+			st.Retention = &sqlite.Retention{Raw: r.Raw, Hourly: r.Hourly, Daily: r.Daily}
+			go st.Downsample(ctx, time.Hour)
+		}
+		*s = st
 	case "":
 		log.Printf("[DEBUG] Storage is not configured")
 		return errors.New("storage is not configured")
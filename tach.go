@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Tach counts fan tachometer pulses and estimates rpm. Safe for concurrent use
+type Tach struct {
+	ppr      int           // pulses per revolution
+	filter   time.Duration // minimal spacing between pulses, closer ones are glitches
+	mx       sync.Mutex
+	pulses   int           // accepted pulses since the last Take
+	glitches int           // rejected pulses since the last Take
+	total    int           // accepted pulses since start
+	first    time.Time     // first accepted pulse since the last Take
+	last     time.Time     // last accepted pulse
+	period   time.Duration // latest interval between accepted pulses
+	taken    time.Time     // last Take
+}
+
+func NewTach(ppr int, filter time.Duration) *Tach {
+	if ppr <= 0 {
+		ppr = 2
+	}
+	return &Tach{ppr: ppr, filter: filter}
+}
+
+// Edge registers a pulse, returns false if it was filtered out as a glitch
+func (t *Tach) Edge(at time.Time) bool {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	if !t.last.IsZero() {
+		spacing := at.Sub(t.last)
+		if spacing < t.filter {
+			t.glitches++
+			return false
+		}
+		t.period = spacing
+	}
+	if t.pulses == 0 {
+		t.first = at
+	}
+	t.last = at
+	t.pulses++
+	t.total++
+	return true
+}
+
+// TachReading is rpm measured since the previous Take
+type TachReading struct {
+	Pulses   int // accepted pulses
+	Glitches int // filtered out pulses
+	Counted  int // rpm from pulse count, steps of 60/ppr rpm for 1 second window
+	RPM      int // rpm from interval between pulses, Counted if there were no pulses
+}
+
+// Take returns rpm since the previous call and resets the counters
+func (t *Tach) Take(now time.Time) TachReading {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	window := time.Second
+	if !t.taken.IsZero() && now.After(t.taken) {
+		window = now.Sub(t.taken)
+	}
+	t.taken = now
+
+	r := TachReading{Pulses: t.pulses, Glitches: t.glitches}
+	r.Counted = int(time.Minute * time.Duration(t.pulses) / (window * time.Duration(t.ppr)))
+	r.RPM = r.Counted
+	if t.pulses >= 2 {
+		// average interval between pulses within the window
+		t.period = t.last.Sub(t.first) / time.Duration(t.pulses-1)
+	}
+	if t.period > 0 {
+		// fan can't be faster than the period suggests, but slower if no pulse came since
+		period := t.period
+		if since := now.Sub(t.last); since > period {
+			period = since
+		}
+		r.RPM = int(time.Minute / (period * time.Duration(t.ppr)))
+		if t.pulses == 0 && now.Sub(t.last) > 2*time.Second {
+			r.RPM = 0 // stopped
+		}
+	}
+	t.pulses, t.glitches = 0, 0
+	return r
+}
+
+// Total returns revolutions counted since start
+func (t *Tach) Total() int {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	return t.total / t.ppr
+}
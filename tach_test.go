@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Tach(t *testing.T) {
+	tach := NewTach(2, time.Millisecond)
+	start := time.Now()
+	tach.Take(start)
+
+	// 1500 rpm, 2 pulses per revolution - 50 pulses per second, 20ms apart
+	for i := 1; i <= 50; i++ {
+		tach.Edge(start.Add(time.Duration(i) * 20 * time.Millisecond))
+	}
+	// glitch right after a pulse
+	assert.False(t, tach.Edge(start.Add(1000*time.Millisecond+100*time.Microsecond)))
+
+	r := tach.Take(start.Add(time.Second))
+	assert.Equal(t, 50, r.Pulses)
+	assert.Equal(t, 1, r.Glitches)
+	assert.Equal(t, 1500, r.Counted)
+	assert.Equal(t, 1500, r.RPM)
+	assert.Equal(t, 25, tach.Total())
+
+	// 20 rpm: one pulse in 1.5 seconds, counting would give 0 or 30 rpm
+	tach = NewTach(0, 0)
+	tach.Edge(start)
+	tach.Edge(start.Add(1500 * time.Millisecond))
+	r = tach.Take(start.Add(1500 * time.Millisecond))
+	assert.Equal(t, 20, r.RPM)
+	r = tach.Take(start.Add(2500 * time.Millisecond))
+	assert.Equal(t, 0, r.Counted)
+	assert.Equal(t, 20, r.RPM)
+
+	// no pulse for 2 seconds - slowing down, then stopped
+	r = tach.Take(start.Add(3500 * time.Millisecond))
+	assert.Equal(t, 15, r.RPM)
+	r = tach.Take(start.Add(4 * time.Second))
+	assert.Equal(t, 0, r.RPM)
+}
+
+func Test_TachConcurrent(t *testing.T) {
+	tach := NewTach(1, 0)
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for g := 0; g < 3; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					tach.Take(time.Now())
+				}
+			}
+		}()
+	}
+	start := time.Now()
+	for i := 0; i < 4000; i++ {
+		tach.Edge(start.Add(time.Duration(i) * time.Millisecond))
+	}
+	close(done)
+	wg.Wait()
+	assert.Equal(t, 4000, tach.Total())
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/parMaster/rpid/config"
+	"github.com/parMaster/rpid/storage"
+	"github.com/parMaster/rpid/storage/model"
+)
+
+// CPUFreqAction caps CPU frequency with cpufreq sysfs interface while the temperature stays high
+// https://www.kernel.org/doc/html/latest/admin-guide/pm/cpufreq.html
+type CPUFreqAction struct {
+	cfg    config.CPUFreq
+	root   string              // sysfs root
+	input  func() (int, error) // m˚C
+	store  storage.Storer
+	mx     sync.Mutex
+	since  time.Time         // when the temperature crossed the threshold
+	capped bool              // settings are changed
+	saved  map[string]string // original settings by file path
+}
+
+func NewCPUFreqAction(cfg config.CPUFreq, sysfs string, input func() (int, error), store storage.Storer) *CPUFreqAction {
+	if sysfs == "" {
+		sysfs = "/sys"
+	}
+	if cfg.Below == 0 {
+		cfg.Below = cfg.Above - 5
+	}
+	if cfg.Duration <= 0 {
+		cfg.Duration = 60
+	}
+	return &CPUFreqAction{cfg: cfg, root: sysfs, input: input, store: store}
+}
+
+// Run checks the temperature every second, restores the settings when ctx is done
+func (a *CPUFreqAction) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			a.mx.Lock()
+			defer a.mx.Unlock()
+			if a.capped {
+				log.Printf("[INFO] Restoring CPU frequency settings on exit")
+				if err := a.restore(); err != nil {
+					log.Printf("[ERROR] Restoring CPU frequency settings: %v", err)
+				}
+			}
+			return
+		case <-ticker.C:
+		}
+
+		temp, err := a.input()
+		if err != nil {
+			log.Printf("[ERROR] Can't read cpufreq input %s: %v", a.cfg.Input, err)
+			continue
+		}
+		a.check(ctx, time.Now(), temp)
+	}
+}
+
+// check caps or restores frequency once the temperature stays beyond the threshold for Duration
+func (a *CPUFreqAction) check(ctx context.Context, now time.Time, temp int) {
+	a.mx.Lock()
+	crossed := (!a.capped && temp > a.cfg.Above*1000) || (a.capped && temp < a.cfg.Below*1000)
+	if !crossed {
+		a.since = time.Time{}
+		a.mx.Unlock()
+		return
+	}
+	if a.since.IsZero() {
+		a.since = now
+	}
+	if now.Sub(a.since) < time.Duration(a.cfg.Duration)*time.Second {
+		a.mx.Unlock()
+		return
+	}
+	a.since = time.Time{}
+
+	event := "capped"
+	if a.capped {
+		event = "restored"
+		err := a.restore()
+		if err != nil {
+			log.Printf("[ERROR] Restoring CPU frequency settings: %v", err)
+		}
+	} else if err := a.cap(); err != nil {
+		log.Printf("[ERROR] Capping CPU frequency: %v", err)
+		a.restore() // don't leave some cores capped
+		event = ""
+	}
+	a.mx.Unlock()
+
+	if event == "" {
+		return
+	}
+	log.Printf("[WARN] CPU frequency %s at %d m˚C", event, temp)
+	if a.store != nil {
+		if err := a.store.Write(ctx, model.Data{Module: "thermal", Topic: "cpufreq", Text: event}); err != nil {
+			log.Printf("[ERROR] Failed to store cpufreq event: %v", err)
+		}
+	}
+}
+
+// policies returns cpufreq directories of all CPUs, sorted. CPUs sharing the policy, like the ones
+// of Raspberry Pi linked to the same policy0, are resolved to it and listed once
+func (a *CPUFreqAction) policies() ([]string, error) {
+	links, err := filepath.Glob(filepath.Join(a.root, "devices/system/cpu/cpu[0-9]*/cpufreq"))
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, link := range links {
+		dir, err := filepath.EvalSymlinks(link)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("no cpufreq found in %s", a.root)
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+// cap saves current settings of all policies, then writes the configured ones
+func (a *CPUFreqAction) cap() error {
+	dirs, err := a.policies()
+	if err != nil {
+		return err
+	}
+	var files []string
+	set := map[string]string{}
+	if a.cfg.Governor != "" {
+		files = append(files, "scaling_governor")
+		set["scaling_governor"] = a.cfg.Governor
+	}
+	if a.cfg.MaxFreq > 0 {
+		files = append(files, "scaling_max_freq")
+		set["scaling_max_freq"] = strconv.Itoa(a.cfg.MaxFreq)
+	}
+
+	saved := map[string]string{}
+	for _, dir := range dirs {
+		for _, file := range files {
+			path := filepath.Join(dir, file)
+			old, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			saved[path] = strings.TrimSpace(string(old))
+		}
+	}
+	a.saved = saved
+	a.capped = true
+	for _, dir := range dirs {
+		for _, file := range files {
+			if err = os.WriteFile(filepath.Join(dir, file), []byte(set[file]), 0o644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// restore writes the saved settings back, in path order
+func (a *CPUFreqAction) restore() error {
+	paths := make([]string, 0, len(a.saved))
+	for path := range a.saved {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var errs []string
+	for _, path := range paths {
+		if err := os.WriteFile(path, []byte(a.saved[path]), 0o644); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		delete(a.saved, path)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	a.capped = false
+	return nil
+}
+
+// Capped reports if CPU frequency is capped
+func (a *CPUFreqAction) Capped() bool {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	return a.capped
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/parMaster/rpid/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSysfs creates cpufreq tree with the given number of CPUs
+func fakeSysfs(t *testing.T, cpus int) string {
+	root := t.TempDir()
+	for i := 0; i < cpus; i++ {
+		dir := filepath.Join(root, "devices/system/cpu", "cpu"+string(rune('0'+i)), "cpufreq")
+		assert.NoError(t, os.MkdirAll(dir, 0o755))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "scaling_max_freq"), []byte("1800000\n"), 0o644))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "scaling_governor"), []byte("ondemand\n"), 0o644))
+	}
+	return root
+}
+
+// fakeSharedSysfs creates cpufreq tree of Raspberry Pi, cpufreq of all CPUs links to policy0
+func fakeSharedSysfs(t *testing.T, cpus int) string {
+	root := t.TempDir()
+	policy := filepath.Join(root, "devices/system/cpu/cpufreq/policy0")
+	assert.NoError(t, os.MkdirAll(policy, 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(policy, "scaling_max_freq"), []byte("1800000\n"), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(policy, "scaling_governor"), []byte("ondemand\n"), 0o644))
+	for i := 0; i < cpus; i++ {
+		dir := filepath.Join(root, "devices/system/cpu", "cpu"+string(rune('0'+i)))
+		assert.NoError(t, os.MkdirAll(dir, 0o755))
+		assert.NoError(t, os.Symlink("../cpufreq/policy0", filepath.Join(dir, "cpufreq")))
+	}
+	return root
+}
+
+func Test_CPUFreqAction(t *testing.T) {
+	root := fakeSysfs(t, 4)
+	read := func(cpu, file string) string {
+		data, err := os.ReadFile(filepath.Join(root, "devices/system/cpu", cpu, "cpufreq", file))
+		assert.NoError(t, err)
+		return string(data)
+	}
+
+	temp := 70000
+	cfg := config.CPUFreq{Enabled: true, Above: 75, Duration: 10, MaxFreq: 1200000, Governor: "powersave"}
+	a := NewCPUFreqAction(cfg, root, func() (int, error) { return temp, nil }, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	now := time.Now()
+
+	// short spike is ignored
+	a.check(ctx, now, 80000)
+	a.check(ctx, now.Add(5*time.Second), 70000)
+	a.check(ctx, now.Add(20*time.Second), 80000)
+	assert.False(t, a.Capped())
+
+	a.check(ctx, now.Add(30*time.Second), 80000)
+	assert.True(t, a.Capped())
+	assert.Equal(t, "1200000", read("cpu3", "scaling_max_freq"))
+	assert.Equal(t, "powersave", read("cpu0", "scaling_governor"))
+
+	// 72˚C is not low enough to restore
+	a.check(ctx, now.Add(40*time.Second), 72000)
+	a.check(ctx, now.Add(60*time.Second), 72000)
+	assert.True(t, a.Capped())
+	a.check(ctx, now.Add(70*time.Second), 69000)
+	a.check(ctx, now.Add(80*time.Second), 69000)
+	assert.False(t, a.Capped())
+	assert.Equal(t, "1800000", read("cpu3", "scaling_max_freq"))
+	assert.Equal(t, "ondemand", read("cpu0", "scaling_governor"))
+
+	// settings are restored on exit
+	a.check(ctx, now.Add(90*time.Second), 80000)
+	a.check(ctx, now.Add(100*time.Second), 80000)
+	assert.True(t, a.Capped())
+	done := make(chan struct{})
+	go func() {
+		a.Run(ctx)
+		close(done)
+	}()
+	cancel()
+	<-done
+	assert.False(t, a.Capped())
+	assert.Equal(t, "1800000", read("cpu1", "scaling_max_freq"))
+
+	// no cpufreq, nothing capped
+	a = NewCPUFreqAction(cfg, t.TempDir(), nil, nil)
+	a.check(ctx, now, 80000)
+	a.check(ctx, now.Add(time.Minute), 80000)
+	assert.False(t, a.Capped())
+}
+
+func Test_CPUFreqAction_sharedPolicy(t *testing.T) {
+	root := fakeSharedSysfs(t, 4)
+	read := func(file string) string {
+		data, err := os.ReadFile(filepath.Join(root, "devices/system/cpu/cpufreq/policy0", file))
+		assert.NoError(t, err)
+		return string(data)
+	}
+
+	cfg := config.CPUFreq{Enabled: true, Above: 75, Duration: 10, MaxFreq: 1200000, Governor: "powersave"}
+	a := NewCPUFreqAction(cfg, root, func() (int, error) { return 80000, nil }, nil)
+	dirs, err := a.policies()
+	assert.NoError(t, err)
+	assert.Len(t, dirs, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		a.check(ctx, now, 80000)
+		a.check(ctx, now.Add(10*time.Second), 80000)
+		assert.True(t, a.Capped())
+		assert.Equal(t, "1200000", read("scaling_max_freq"))
+		assert.Equal(t, "powersave", read("scaling_governor"))
+
+		a.check(ctx, now.Add(20*time.Second), 60000)
+		a.check(ctx, now.Add(30*time.Second), 60000)
+		assert.False(t, a.Capped())
+		assert.Equal(t, "1800000", read("scaling_max_freq"), "original frequency is restored, not the capped one")
+		assert.Equal(t, "ondemand", read("scaling_governor"))
+		now = now.Add(time.Minute)
+	}
+
+	// settings are restored on exit
+	a.check(ctx, now, 80000)
+	a.check(ctx, now.Add(10*time.Second), 80000)
+	done := make(chan struct{})
+	go func() {
+		a.Run(ctx)
+		close(done)
+	}()
+	cancel()
+	<-done
+	assert.Equal(t, "1800000", read("scaling_max_freq"))
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/parMaster/rpid/config"
+	"github.com/parMaster/rpid/storage"
+	"github.com/parMaster/rpid/storage/model"
+)
+
+// emergency escalation steps, in order
+const (
+	EmergencyLog      = "log"
+	EmergencyNotify   = "notify"
+	EmergencyCommand  = "command"
+	EmergencyShutdown = "shutdown"
+)
+
+// EmergencyGuard runs the escalation chain while the temperature stays above critical
+type EmergencyGuard struct {
+	cfg   config.Emergency
+	input func() (int, error) // m˚C
+	store storage.Storer
+	exec  func(ctx context.Context, command string) error // runs shell command
+	mx    sync.Mutex
+	since time.Time       // when the temperature went above critical, zero if it's below
+	done  map[string]bool // steps taken since then
+}
+
+func NewEmergencyGuard(cfg config.Emergency, input func() (int, error), store storage.Storer) *EmergencyGuard {
+	if cfg.LogAfter <= 0 {
+		cfg.LogAfter = 10
+	}
+	if cfg.NotifyAfter <= 0 {
+		cfg.NotifyAfter = 30
+	}
+	if cfg.CommandAfter <= 0 {
+		cfg.CommandAfter = 60
+	}
+	if cfg.ShutdownAfter <= 0 {
+		cfg.ShutdownAfter = 300
+	}
+	cfg.ShutdownAfter = max(cfg.ShutdownAfter, 60)
+	if cfg.ShutdownCmd == "" {
+		cfg.ShutdownCmd = "shutdown -h now"
+	}
+	return &EmergencyGuard{cfg: cfg, input: input, store: store, exec: runCommand, done: map[string]bool{}}
+}
+
+// Run checks the temperature every second, until ctx is done
+func (g *EmergencyGuard) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		temp, err := g.input()
+		if err != nil {
+			log.Printf("[ERROR] Can't read emergency input %s: %v", g.cfg.Input, err)
+			continue
+		}
+		g.check(ctx, time.Now(), temp)
+	}
+}
+
+// check takes the escalation steps due by the time spent above critical
+func (g *EmergencyGuard) check(ctx context.Context, now time.Time, temp int) {
+	g.mx.Lock()
+	if temp < g.cfg.Critical*1000 {
+		recovered := !g.since.IsZero() && len(g.done) > 0
+		g.since, g.done = time.Time{}, map[string]bool{}
+		g.mx.Unlock()
+		if recovered {
+			g.event(ctx, "recovered", temp)
+		}
+		return
+	}
+	if g.since.IsZero() {
+		g.since = now
+	}
+	above := now.Sub(g.since)
+
+	steps := []struct {
+		name    string
+		after   int
+		enabled bool
+	}{
+		{EmergencyLog, g.cfg.LogAfter, true},
+		{EmergencyNotify, g.cfg.NotifyAfter, g.cfg.Notify != ""},
+		{EmergencyCommand, g.cfg.CommandAfter, g.cfg.Command != ""},
+		{EmergencyShutdown, g.cfg.ShutdownAfter, g.cfg.Shutdown},
+	}
+	var due []string
+	for _, s := range steps {
+		if s.enabled && !g.done[s.name] && above >= time.Duration(s.after)*time.Second {
+			g.done[s.name] = true
+			due = append(due, s.name)
+		}
+	}
+	g.mx.Unlock()
+
+	for _, step := range due {
+		g.take(ctx, step, temp, above)
+	}
+}
+
+// take runs the escalation step, or only logs it in dry run mode
+func (g *EmergencyGuard) take(ctx context.Context, step string, temp int, above time.Duration) {
+	msg := fmt.Sprintf("%s is %d m˚C, above critical %d˚C for %s", g.inputName(), temp, g.cfg.Critical, above.Truncate(time.Second))
+	if step == EmergencyLog {
+		log.Printf("[WARN] Emergency: %s", msg)
+		g.event(ctx, step, temp)
+		return
+	}
+	if g.cfg.DryRun {
+		log.Printf("[WARN] Emergency dry run, %s is not taken: %s", step, msg)
+		g.event(ctx, step+" (dry run)", temp)
+		return
+	}
+
+	var err error
+	switch step {
+	case EmergencyNotify:
+		err = g.notify(ctx, msg, temp)
+	case EmergencyCommand:
+		err = g.exec(ctx, g.cfg.Command)
+	case EmergencyShutdown:
+		log.Printf("[WARN] Emergency shutdown: %s", msg)
+		err = g.exec(ctx, g.cfg.ShutdownCmd)
+	}
+	if err != nil {
+		log.Printf("[ERROR] Emergency %s failed: %v", step, err)
+		g.event(ctx, step+" failed", temp)
+		return
+	}
+	g.event(ctx, step, temp)
+}
+
+// inputName returns the input name, thermal zone by default
+func (g *EmergencyGuard) inputName() string {
+	if g.cfg.Input == "" {
+		return "thermal_zone0"
+	}
+	return g.cfg.Input
+}
+
+// notify posts the alert as JSON to the configured URL
+func (g *EmergencyGuard) notify(ctx context.Context, msg string, temp int) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"message":  msg,
+		"input":    g.inputName(),
+		"temp":     temp,
+		"critical": g.cfg.Critical,
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.cfg.Notify, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("notification rejected: %s", resp.Status)
+	}
+	return nil
+}
+
+func (g *EmergencyGuard) event(ctx context.Context, value string, temp int) {
+	if g.store == nil {
+		return
+	}
+	if err := g.store.Write(ctx, model.Data{Module: "thermal", Topic: "emergency", Text: fmt.Sprintf("%s at %d m˚C", value, temp)}); err != nil {
+		log.Printf("[ERROR] Failed to store emergency event: %v", err)
+	}
+}
+
+// Active returns the time the temperature went above critical, zero if it's below
+func (g *EmergencyGuard) Active() time.Time {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	return g.since
+}
+
+// runCommand runs the shell command, giving it 30 seconds to finish
+func runCommand(ctx context.Context, command string) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "sh", "-c", command).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %w, %s", command, err, bytes.TrimSpace(out))
+	}
+	log.Printf("[INFO] %s: %s", command, bytes.TrimSpace(out))
+	return nil
+}
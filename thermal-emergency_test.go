@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/parMaster/rpid/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_EmergencyGuard(t *testing.T) {
+	var alerts []map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var alert map[string]interface{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&alert))
+		alerts = append(alerts, alert)
+	}))
+	defer ts.Close()
+
+	cfg := config.Emergency{Enabled: true, Input: "bmp280/temp", Critical: 60, Notify: ts.URL,
+		Command: "lights-out", Shutdown: true, ShutdownAfter: 10}
+	g := NewEmergencyGuard(cfg, nil, nil)
+	var commands []string
+	g.exec = func(ctx context.Context, command string) error {
+		commands = append(commands, command)
+		return nil
+	}
+	ctx := context.Background()
+	now := time.Now()
+
+	// shutdown delay can't be that short
+	assert.Equal(t, 60, g.cfg.ShutdownAfter)
+
+	g.check(ctx, now, 61000)
+	assert.Equal(t, now, g.Active())
+	g.check(ctx, now.Add(30*time.Second), 61000)
+	assert.Len(t, alerts, 1)
+	assert.Equal(t, "bmp280/temp", alerts[0]["input"])
+	assert.Empty(t, commands)
+
+	g.check(ctx, now.Add(60*time.Second), 61000)
+	g.check(ctx, now.Add(61*time.Second), 62000)
+	assert.Equal(t, []string{"lights-out", "shutdown -h now"}, commands)
+	assert.Len(t, alerts, 1)
+
+	// chain starts over after recovery
+	g.check(ctx, now.Add(70*time.Second), 59000)
+	assert.True(t, g.Active().IsZero())
+	g.check(ctx, now.Add(80*time.Second), 61000)
+	g.check(ctx, now.Add(110*time.Second), 61000)
+	assert.Len(t, alerts, 2)
+
+	// dry run only logs
+	cfg.DryRun = true
+	g = NewEmergencyGuard(cfg, nil, nil)
+	g.exec = func(ctx context.Context, command string) error {
+		t.Errorf("%s must not run in dry run", command)
+		return nil
+	}
+	g.check(ctx, now, 61000)
+	g.check(ctx, now.Add(time.Hour), 61000)
+	assert.Len(t, alerts, 2)
+	assert.True(t, g.done[EmergencyShutdown])
+}
+
+func Test_RunCommand(t *testing.T) {
+	assert.NoError(t, runCommand(context.Background(), "echo ok"))
+	assert.Error(t, runCommand(context.Background(), "exit 3"))
+}
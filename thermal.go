@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Kernel thermal framework, sysfs interface
+// https://www.kernel.org/doc/Documentation/ABI/testing/sysfs-class-thermal
+
+// ThermalZone is the kernel thermal zone with its trip points
+type ThermalZone struct {
+	Name  string // thermal_zone0
+	Type  string // cpu-thermal
+	Trips []TripPoint
+}
+
+// TripPoint is the temperature the kernel takes action at
+type TripPoint struct {
+	Type string // active, passive, hot or critical
+	Temp int    // m˚C
+}
+
+// readThermalZone reads the temperature of the thermal zone, m˚C
+func readThermalZone(sysfs, zone string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(sysfs, "class/thermal", zone, "temp"))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// readThermalZones lists all thermal zones with their types and trip points
+func readThermalZones(sysfs string) ([]ThermalZone, error) {
+	dirs, err := filepath.Glob(filepath.Join(sysfs, "class/thermal/thermal_zone*"))
+	if err != nil {
+		return nil, err
+	}
+	var zones []ThermalZone
+	for _, dir := range dirs {
+		z := ThermalZone{Name: filepath.Base(dir), Type: readString(filepath.Join(dir, "type"))}
+		temps, _ := filepath.Glob(filepath.Join(dir, "trip_point_*_temp"))
+		sort.Strings(temps)
+		for _, path := range temps {
+			temp, err := strconv.Atoi(readString(path))
+			if err != nil {
+				continue
+			}
+			z.Trips = append(z.Trips, TripPoint{
+				Type: readString(strings.TrimSuffix(path, "_temp") + "_type"),
+				Temp: temp,
+			})
+		}
+		zones = append(zones, z)
+	}
+	sort.Slice(zones, func(i, j int) bool { return zoneIndex(zones[i].Name) < zoneIndex(zones[j].Name) })
+	return zones, nil
+}
+
+// zoneIndex returns the number of thermal_zoneN
+func zoneIndex(name string) int {
+	n, _ := strconv.Atoi(strings.TrimPrefix(name, "thermal_zone"))
+	return n
+}
+
+func readString(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// SuggestThresholds proposes fan high and low temperatures ˚C from the zone trip points:
+// the first active trip (where the kernel would start a fan) or 15˚C below the first passive
+// (where the kernel would start throttling) is high, low is 5˚C below it
+func (z ThermalZone) SuggestThresholds() (high, low int, err error) {
+	active, passive := math.MaxInt, math.MaxInt
+	for _, t := range z.Trips {
+		switch t.Type {
+		case "active":
+			active = min(active, t.Temp)
+		case "passive":
+			passive = min(passive, t.Temp)
+		}
+	}
+	switch {
+	case active != math.MaxInt:
+		high = active / 1000
+	case passive != math.MaxInt:
+		high = passive/1000 - 15
+	default:
+		return 0, 0, fmt.Errorf("%s has no active or passive trip points", z.Name)
+	}
+	return high, high - 5, nil
+}
+
+// coolingFan drives the fan through the kernel cooling device, like the one gpio-fan or pwm-fan overlays create.
+// Duty is mapped to cooling states 0..max_state
+type coolingFan struct {
+	dir      string
+	maxState int
+	duty     int
+	mx       sync.Mutex
+}
+
+func NewCoolingFan(sysfs, device string) (*coolingFan, error) {
+	if device == "" {
+		return nil, fmt.Errorf("cooling device is not set")
+	}
+	dir := filepath.Join(sysfs, "class/thermal", device)
+	maxState, err := strconv.Atoi(readString(filepath.Join(dir, "max_state")))
+	if err != nil || maxState <= 0 {
+		return nil, fmt.Errorf("can't read %s max_state: %v", device, err)
+	}
+	return &coolingFan{dir: dir, maxState: maxState}, nil
+}
+
+func (f *coolingFan) SetDuty(duty int) error {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	duty = clamp(duty, 0, 100)
+	state := int(math.Ceil(float64(duty*f.maxState) / 100)) // any duty above 0 spins the fan
+	if err := os.WriteFile(filepath.Join(f.dir, "cur_state"), []byte(strconv.Itoa(state)), 0o644); err != nil {
+		return fmt.Errorf("setting cooling state %d: %w", state, err)
+	}
+	f.duty = duty
+	return nil
+}
+
+func (f *coolingFan) Duty() int {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	return f.duty
+}
+
+// Halt leaves the fan at max state, the kernel governor takes it over from there
+func (f *coolingFan) Halt() error {
+	return f.SetDuty(100)
+}
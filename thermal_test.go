@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/parMaster/rpid/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeThermal creates thermal class tree: files by path relative to class/thermal
+func fakeThermal(t *testing.T, files map[string]string) string {
+	root := t.TempDir()
+	for path, value := range files {
+		path = filepath.Join(root, "class/thermal", path)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		assert.NoError(t, os.WriteFile(path, []byte(value+"\n"), 0o644))
+	}
+	return root
+}
+
+func Test_ThermalZones(t *testing.T) {
+	root := fakeThermal(t, map[string]string{
+		"thermal_zone0/type":              "cpu-thermal",
+		"thermal_zone0/temp":              "48312",
+		"thermal_zone0/trip_point_0_type": "critical",
+		"thermal_zone0/trip_point_0_temp": "110000",
+		"thermal_zone0/trip_point_1_type": "passive",
+		"thermal_zone0/trip_point_1_temp": "80000",
+		"thermal_zone2/type":              "gpu-thermal",
+		"thermal_zone2/temp":              "41000",
+		"thermal_zone2/trip_point_0_type": "active",
+		"thermal_zone2/trip_point_0_temp": "65000",
+		"thermal_zone10/type":             "battery",
+		"thermal_zone10/temp":             "30000",
+	})
+
+	zones, err := readThermalZones(root)
+	assert.NoError(t, err)
+	assert.Len(t, zones, 3)
+	assert.Equal(t, "thermal_zone0", zones[0].Name)
+	assert.Equal(t, "cpu-thermal", zones[0].Type)
+	assert.Equal(t, []TripPoint{{"critical", 110000}, {"passive", 80000}}, zones[0].Trips)
+	assert.Equal(t, "thermal_zone10", zones[2].Name)
+
+	temp, err := readThermalZone(root, "thermal_zone2")
+	assert.NoError(t, err)
+	assert.Equal(t, 41000, temp)
+
+	// passive trip only: high is 15˚C below throttling
+	high, low, err := zones[0].SuggestThresholds()
+	assert.NoError(t, err)
+	assert.Equal(t, []int{65, 60}, []int{high, low})
+
+	// active trip is where the kernel would start a fan
+	high, low, err = zones[1].SuggestThresholds()
+	assert.NoError(t, err)
+	assert.Equal(t, []int{65, 60}, []int{high, low})
+
+	_, _, err = zones[2].SuggestThresholds()
+	assert.Error(t, err)
+
+	w := &Worker{config: config.Parameters{Thermal: config.Thermal{Sysfs: root}}}
+	cfg := w.suggestThresholds(config.Fan{Input: "thermal_zone2"})
+	assert.Equal(t, 65, cfg.High)
+	cfg = w.suggestThresholds(config.Fan{High: 55, Low: 50})
+	assert.Equal(t, 55, cfg.High)
+
+	// PID fan falls back to the suggested high temperature, the one without trip points isn't loaded
+	pid := config.Fan{Input: "thermal_zone2", Policy: "pid", PID: config.PID{Kp: 5}}
+	_, err = NewFanController(w.suggestThresholds(pid), nil, nil, root, config.History{})
+	assert.NoError(t, err)
+	pid.Input = "thermal_zone10"
+	_, err = NewFanController(w.suggestThresholds(pid), nil, nil, root, config.History{})
+	assert.ErrorContains(t, err, "setpoint")
+
+	r, err := LoadZonesReporter(config.ThermalZones{Enabled: true}, root, nil, config.History{})
+	assert.NoError(t, err)
+	assert.NoError(t, r.Collect(context.Background()))
+	v, ok := r.Last("thermal_zone0")
+	assert.True(t, ok)
+	assert.Equal(t, 48312.0, v)
+	_, ok = r.Last("thermal_zone1")
+	assert.False(t, ok)
+}
+
+func Test_CoolingFan(t *testing.T) {
+	root := fakeThermal(t, map[string]string{
+		"cooling_device0/type":      "gpio-fan",
+		"cooling_device0/max_state": "4",
+		"cooling_device0/cur_state": "0",
+	})
+	state := func() string {
+		data, err := os.ReadFile(filepath.Join(root, "class/thermal/cooling_device0/cur_state"))
+		assert.NoError(t, err)
+		return string(data)
+	}
+
+	_, err := NewCoolingFan(root, "cooling_device1")
+	assert.Error(t, err)
+
+	f, err := NewCoolingFan(root, "cooling_device0")
+	assert.NoError(t, err)
+
+	for duty, want := range map[int]string{0: "0", 10: "1", 50: "2", 60: "3", 100: "4"} {
+		assert.NoError(t, f.SetDuty(duty))
+		assert.Equal(t, want, state(), "duty %d", duty)
+		assert.Equal(t, duty, f.Duty())
+	}
+
+	assert.NoError(t, f.Halt())
+	assert.Equal(t, "4", state())
+}
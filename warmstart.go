@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/parMaster/rpid/storage/model"
+)
+
+// warmStart prefills in-memory history of CPU temperature, fans and modules with stored data,
+// so charts and fan policies don't start blank after restart
+func (w *Worker) warmStart(ctx context.Context) {
+	if w.store == nil {
+		return
+	}
+	since := time.Now().Add(-w.config.History.WithDefaults().WarmStart)
+
+	if data, err := w.store.ReadSince(ctx, "main", since); err != nil {
+		log.Printf("[INFO] No stored main data to warm start from: %v", err)
+	} else {
+		w.mx.Lock()
+		for _, d := range data {
+			if d.Topic == "temp" {
+				restorePoint(w.data["temp"], d, toInt)
+			}
+		}
+		w.mx.Unlock()
+		for _, f := range w.fans {
+			f.Restore(data)
+		}
+		log.Printf("[INFO] Warm start: %d main records since %s", len(data), since.Format(model.DateTimeFormat))
+	}
+
+	for _, m := range w.modules {
+		r, ok := m.(Restorer)
+		if !ok {
+			continue
+		}
+		data, err := w.store.ReadSince(ctx, m.Name(), since)
+		if err != nil {
+			log.Printf("[INFO] No stored %s data to warm start from: %v", m.Name(), err)
+			continue
+		}
+		r.Restore(data)
+		log.Printf("[INFO] Warm start: %d %s records", len(data), m.Name())
+	}
+}
+
+// restorePoint adds the stored measurement to the series, skipping non-numeric records
+func restorePoint[T any](s *Series[T], d model.Data, convert func(float64) T) {
+	if d.Text != "" {
+		return
+	}
+	s.Add(d.Time, convert(d.Value))
+}
+
+func toInt(v float64) int { return int(v) }
+
+func toShortFloat(v float64) ShortFloat { return ShortFloat(v) }
+
+func toString(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
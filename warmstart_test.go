@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/parMaster/rpid/config"
+	"github.com/parMaster/rpid/storage/model"
+	"github.com/parMaster/rpid/storage/sqlite"
+	"github.com/stretchr/testify/assert"
+	"periph.io/x/conn/v3/gpio"
+)
+
+func Test_WarmStart(t *testing.T) {
+	ctx := context.Background()
+	store, err := sqlite.NewStorage(ctx, filepath.Join(t.TempDir(), "warm.db"))
+	assert.NoError(t, err)
+	_, _, err = store.Migrate(ctx, false)
+	assert.NoError(t, err)
+
+	now := time.Now().Truncate(time.Minute)
+	write := func(module, topic string, value float64, ago time.Duration) {
+		assert.NoError(t, store.Write(ctx, model.Data{Module: module, Time: now.Add(-ago), Topic: topic, Value: value}))
+	}
+	write("main", "temp", 30000, 10*24*time.Hour) // older than retention
+	for i := 3; i > 0; i-- {
+		write("main", "temp", 50000, time.Duration(i)*time.Minute)
+		write("main", "exhaust_duty", 100, time.Duration(i)*time.Minute)
+		write("system", "la5m", 0.5, time.Duration(i)*time.Minute)
+	}
+	assert.NoError(t, store.Write(ctx, model.Data{Module: "system", Topic: "la5m", Text: "not a measurement"}))
+
+	cfg := config.Fan{Name: "exhaust", High: 48, Low: 40}
+	policy, err := NewFanPolicy(cfg)
+	assert.NoError(t, err)
+	fan := &FanController{
+		cfg:    cfg,
+		input:  func() (int, error) { return 50000, nil },
+		fan:    &onOffFan{pin: &testPin{PinIO: gpio.INVALID}},
+		policy: policy,
+		data:   testHistory(),
+	}
+	sys, err := LoadSystemReporter(config.System{Enabled: true}, nil, true, config.History{})
+	assert.NoError(t, err)
+	w := &Worker{
+		data:    historical{"t": secondly[int](config.History{}), "temp": minutely[int](config.History{})},
+		store:   store,
+		fans:    []*FanController{fan},
+		modules: Modules{sys},
+	}
+	w.warmStart(ctx)
+
+	assert.Equal(t, []int{50000, 50000, 50000}, w.data["temp"].Values())
+	p, _ := w.data["temp"].Last()
+	assert.Equal(t, now.Add(-time.Minute), p.Time)
+	assert.Equal(t, []int{100, 100, 100}, fan.data["duty"].Values())
+	assert.Equal(t, []ShortFloat{0.5, 0.5, 0.5}, sys.data.LoadAvg["5m"].Values())
+
+	// named fan follows its own input, nothing stored for it
+	assert.Equal(t, 0, fan.data["temp"].Len())
+
+	// fan policy decides on restored minutes right away, stale ones are ignored
+	fan.Restore([]model.Data{
+		{Module: "main", Time: now.Add(-2 * time.Hour), Topic: "exhaust_temp", Value: 30000},
+		{Module: "main", Time: now.Add(-2 * time.Minute), Topic: "exhaust_temp", Value: 50000},
+		{Module: "main", Time: now.Add(-time.Minute), Topic: "exhaust_temp", Value: 50000},
+	})
+	h := fan.history(now)
+	assert.Equal(t, []int{50000, 50000}, h.Minutes)
+	assert.Equal(t, "high temperature", policy.Decide(h).Rule)
+
+	// unnamed fan shares CPU temperature topic, restored only if it follows CPU temperature
+	cpuData := []model.Data{{Module: "main", Time: now.Add(-time.Minute), Topic: "temp", Value: 50000}}
+	for input, restored := range map[string]int{"": 1, "thermal_zone0": 1, "thermal_zone1": 0, "bmp280/temp": 0} {
+		unnamed := &FanController{cfg: config.Fan{Input: input}, data: testHistory()}
+		unnamed.Restore(cpuData)
+		assert.Equal(t, restored, unnamed.data["temp"].Len(), input)
+	}
+}